@@ -14,12 +14,12 @@ type Header struct {
 
 // Error struct
 type Message struct {
-	Event  string  `json:"event"`
-	Oid    string  `json:"oid"`
-	Size   *int64  `json:"size,omitempty"`
-	Path   string  `json:"path,omitempty"`
-	Action string  `json:"action,omitempty"`
-	Error  *Error  `json:"error,omitempty"`
+	Event  string `json:"event"`
+	Oid    string `json:"oid"`
+	Size   *int64 `json:"size,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Action string `json:"action,omitempty"`
+	Error  *Error `json:"error,omitempty"`
 }
 
 type Error struct {
@@ -36,6 +36,24 @@ type Request struct {
 	Oid                 string  `json:"oid"`
 	Size                int64   `json:"size"`
 	Path                string  `json:"path"`
+	Remote              string  `json:"remote,omitempty"`
+	Action              *Action `json:"action,omitempty"`
+	Range               *Range  `json:"range,omitempty"`
+}
+
+// Range of bytes of an object to download instead of the whole object, with
+// the SHA-256 of the range in hexadecimal when the caller knows it
+type Range struct {
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	Sha256 string `json:"sha256,omitempty"`
+}
+
+// Action given by the LFS API for an object, null for standalone agents
+type Action struct {
+	Href      string            `json:"href"`
+	Header    map[string]string `json:"header,omitempty"`
+	ExpiresAt string            `json:"expires_at,omitempty"`
 }
 
 // InitResponse with response for init
@@ -45,9 +63,9 @@ type InitResponse struct {
 
 // TransferResponse generic transfer response
 type TransferResponse struct {
-	Event string         `json:"event"`
-	Oid   string         `json:"oid"`
-	Path  string         `json:"path,omitempty"` // always blank for upload
+	Event string `json:"event"`
+	Oid   string `json:"oid"`
+	Path  string `json:"path,omitempty"` // always blank for upload
 	Error *Error `json:"error,omitempty"`
 }
 
@@ -63,7 +81,7 @@ type ProgressResponse struct {
 func SendResponse(r interface{}, writer io.Writer, stderr io.Writer) error {
 	b, err := json.Marshal(r)
 	if err != nil {
-		fmt.Fprintf(stderr, fmt.Sprintf("Error marshalling response: %s", err))
+		fmt.Fprintf(stderr, "Error marshalling response: %s", err)
 		return err
 	}
 	// Line oriented JSON
@@ -72,7 +90,7 @@ func SendResponse(r interface{}, writer io.Writer, stderr io.Writer) error {
 	if err != nil {
 		return err
 	}
-	fmt.Fprintf(stderr, fmt.Sprintf("Sent message %v", string(b)))
+	fmt.Fprintf(stderr, "Sent message %v", string(b))
 	return nil
 }
 
@@ -81,15 +99,17 @@ func SendTransferError(oid string, code int, message string, writer io.Writer, s
 	resp := &TransferResponse{"complete", oid, "", &Error{code, message}}
 	err := SendResponse(resp, writer, stderr)
 	if err != nil {
-		fmt.Fprintf(stderr, fmt.Sprintf("Unable to send transfer error: %v\n", err))
+		fmt.Fprintf(stderr, "Unable to send transfer error: %v\n", err)
 	}
 }
 
-// SendProgress reports progress on operations
-func SendProgress(oid string, bytesSoFar int64, bytesSinceLast int, writer io.Writer, stderr io.Writer) {
+// SendProgress reports progress on operations. An error means lfs can no
+// longer be reached, so the operation should be abandoned.
+func SendProgress(oid string, bytesSoFar int64, bytesSinceLast int, writer io.Writer, stderr io.Writer) error {
 	resp := &ProgressResponse{"progress", oid, bytesSoFar, bytesSinceLast}
 	err := SendResponse(resp, writer, stderr)
 	if err != nil {
-		fmt.Fprintf(stderr, fmt.Sprintf("Unable to send progress update: %v\n", err))
+		fmt.Fprintf(stderr, "Unable to send progress update: %v\n", err)
 	}
+	return err
 }
@@ -24,7 +24,21 @@ func init() {
 	flag.Usage = func() {
 		usage := `
 Usage:
-  git-lfs-s3 [options]
+  git-lfs-s3 [options] [command]
+
+Commands:
+  selftest     Upload, download and delete a small object to check the configuration
+  delete OID   Delete the objects with the given OIDs from the bucket
+  abort-uploads
+               Abort the unfinished multipart uploads of the repository
+  prefetch [FILE]
+               Download the objects listed by git lfs ls-files --long in FILE
+               or stdin into the local LFS store
+  verify [FILE]
+               Check that the objects listed in FILE or stdin are in the
+               bucket with the listed size, without downloading them
+  cat OID      Write the object with the given OID to stdout
+  benchmark    Upload, download and delete random objects to measure throughput
 
 Options:
   --version    Report the version number and exit
@@ -36,25 +50,88 @@ Note:
 
   The arguments should be provided via gitconfig at lfs.customtransfer.<name>.args
 `
-		fmt.Fprintf(os.Stderr, usage)
+		fmt.Fprint(os.Stderr, usage)
 	}
 }
 
 // Execute runs the main logic of the program and handles command line arguments.
 func execute() {
 	flag.Parse()
+	service.Version = Version
 
 	if printVersion {
 		os.Stderr.WriteString(fmt.Sprintf("git-lfs-s3 %v\n", Version))
 		os.Exit(0)
 	}
 
-	service.Serve(os.Stdin, os.Stdout, func() io.Writer {
+	stderr := func() io.Writer {
 		if debug {
 			return os.Stderr
 		}
 		return io.Discard
-	}())
+	}()
+	service.DebugLog = stderr
+
+	switch flag.Arg(0) {
+	case "":
+		service.Serve(os.Stdin, os.Stdout, stderr)
+	case "selftest":
+		if !service.SelfTest(os.Stdout, stderr) {
+			os.Exit(1)
+		}
+	case "delete":
+		if !service.Delete(flag.Args()[1:], os.Stdout, stderr) {
+			os.Exit(1)
+		}
+	case "abort-uploads":
+		if !service.AbortUploads(os.Stdout, stderr) {
+			os.Exit(1)
+		}
+	case "prefetch":
+		input := io.Reader(os.Stdin)
+		if flag.NArg() > 1 {
+			file, err := os.Open(flag.Arg(1))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to open %s: %v\n", flag.Arg(1), err)
+				os.Exit(1)
+			}
+			defer file.Close()
+			input = file
+		}
+		if !service.Prefetch(input, os.Stdout, stderr) {
+			os.Exit(1)
+		}
+	case "verify":
+		input := io.Reader(os.Stdin)
+		if flag.NArg() > 1 {
+			file, err := os.Open(flag.Arg(1))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to open %s: %v\n", flag.Arg(1), err)
+				os.Exit(1)
+			}
+			defer file.Close()
+			input = file
+		}
+		if !service.Verify(input, os.Stdout, stderr) {
+			os.Exit(1)
+		}
+	case "cat":
+		if flag.NArg() != 2 {
+			fmt.Fprintf(os.Stderr, "Usage: git-lfs-s3 cat OID\n")
+			os.Exit(2)
+		}
+		if !service.Cat(flag.Arg(1), os.Stdout, os.Stderr) {
+			os.Exit(1)
+		}
+	case "benchmark":
+		if !service.Benchmark(os.Stdout, stderr) {
+			os.Exit(1)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
 }
 
 func main() {
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"golang.org/x/sync/errgroup"
+)
+
+// AbortUploads aborts the unfinished multipart uploads of the repository,
+// such as those kept by S3_LEAVE_PARTS_ON_ERROR, printing each aborted
+// upload to stdout. It returns false if any of them could not be aborted.
+func AbortUploads(stdout, stderr io.Writer) bool {
+	if err := checkConfig(); err != nil {
+		fmt.Fprintf(stdout, "Configuration error: %v\n", err)
+		return false
+	}
+
+	ctx := context.Background()
+	client, err := getS3Client()
+	if err != nil {
+		fmt.Fprintf(stdout, "Error creating client: %s\n", describeError(err))
+		return false
+	}
+	prefix, err := objectKeyPrefix()
+	if err != nil {
+		fmt.Fprintf(stdout, "Error listing uploads: %v\n", err)
+		return false
+	}
+	pageSize, err := listPageSize()
+	if err != nil {
+		fmt.Fprintf(stdout, "Configuration error: %v\n", err)
+		return false
+	}
+	bucketName := os.Getenv("S3_BUCKET")
+
+	var mu sync.Mutex
+	stdout = &syncWriter{w: stdout}
+	ok := true
+	failed := func() {
+		mu.Lock()
+		ok = false
+		mu.Unlock()
+	}
+
+	// Every shard is listed on its own, which matters for buckets with
+	// many abandoned uploads.
+	var group errgroup.Group
+	for _, shard := range listShards(prefix) {
+		group.Go(func() error {
+			input := &s3.ListMultipartUploadsInput{
+				Bucket:     aws.String(bucketName),
+				Prefix:     aws.String(shard),
+				MaxUploads: pageSize,
+			}
+			for {
+				page, err := client.ListMultipartUploads(ctx, input)
+				if err != nil {
+					return err
+				}
+				for _, upload := range page.Uploads {
+					_, err := client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+						Bucket:   aws.String(bucketName),
+						Key:      upload.Key,
+						UploadId: upload.UploadId,
+					})
+					if err != nil && !isNotFound(err) {
+						fmt.Fprintf(stdout, "Error aborting upload %s of %s: %s\n", aws.ToString(upload.UploadId), aws.ToString(upload.Key), describeError(err))
+						failed()
+						continue
+					}
+					fmt.Fprintf(stdout, "Aborted upload %s of %s\n", aws.ToString(upload.UploadId), aws.ToString(upload.Key))
+				}
+				if !aws.ToBool(page.IsTruncated) {
+					return nil
+				}
+				input.KeyMarker = page.NextKeyMarker
+				input.UploadIdMarker = page.NextUploadIdMarker
+			}
+		})
+	}
+	if err := group.Wait(); err != nil {
+		fmt.Fprintf(stdout, "Error listing uploads: %s\n", describeError(err))
+		return false
+	}
+	return ok
+}
@@ -0,0 +1,41 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+)
+
+// accessPointARN returns S3_BUCKET parsed as an access point ARN, such as
+// arn:aws:s3:us-west-2:123456789012:accesspoint/name, or as a Multi-Region
+// Access Point ARN without a region, and whether it is one.
+func accessPointARN() (arn.ARN, bool) {
+	bucket := os.Getenv("S3_BUCKET")
+	if !arn.IsARN(bucket) {
+		return arn.ARN{}, false
+	}
+	parsed, err := arn.Parse(bucket)
+	if err != nil {
+		return arn.ARN{}, false
+	}
+	return parsed, true
+}
+
+// checkAccessPoint validates the configuration for an access point ARN in
+// S3_BUCKET. Bucket names can't hold colons, so anything starting like an
+// ARN has to be one.
+func checkAccessPoint() error {
+	if !strings.HasPrefix(os.Getenv("S3_BUCKET"), "arn:") {
+		return nil
+	}
+	parsed, ok := accessPointARN()
+	if !ok || parsed.Service != "s3" || !strings.HasPrefix(parsed.Resource, "accesspoint/") {
+		return fmt.Errorf("S3_BUCKET %s is not an S3 access point ARN, expected arn:<partition>:s3:<region>:<account>:accesspoint/<name>", os.Getenv("S3_BUCKET"))
+	}
+	if envBool("S3_USEPATHSTYLE") {
+		return fmt.Errorf("access points do not support path-style addressing")
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestCheckAccessPoint(t *testing.T) {
+	tests := []struct {
+		bucket    string
+		pathStyle string
+		ok        bool
+	}{
+		{"bucket", "", true},
+		{"arn:aws:s3:us-west-2:123456789012:accesspoint/myap", "", true},
+		{"arn:aws:s3::123456789012:accesspoint/mfzwi23gnjvgw.mrap", "", true},
+		{"arn:aws:s3:us-west-2:123456789012:accesspoint/myap", "true", false},
+		{"arn:aws:s3:us-west-2:123456789012:bucket/myap", "", false},
+		{"arn:aws:iam::123456789012:accesspoint/myap", "", false},
+		{"arn:aws:s3:us-west-2:123456789012", "", false},
+	}
+	for _, test := range tests {
+		t.Setenv("S3_BUCKET", test.bucket)
+		t.Setenv("S3_USEPATHSTYLE", test.pathStyle)
+		if err := checkAccessPoint(); (err == nil) != test.ok {
+			t.Errorf("checkAccessPoint() with S3_BUCKET=%s, S3_USEPATHSTYLE=%s = %v", test.bucket, test.pathStyle, err)
+		}
+	}
+}
+
+func TestAccessPointRequests(t *testing.T) {
+	unsetenv(t, "AWS_CA_BUNDLE", "AWS_S3_ENDPOINT", "AWS_S3_ENDPOINTS", "AWS_ENDPOINT_URL", "AWS_ENDPOINT_URL_S3",
+		"AWS_PROFILE", "AWS_SIGNING_REGION", "S3_USEPATHSTYLE", "S3_EXPRESS")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	tests := []struct {
+		name   string
+		bucket string
+		region string
+		url    string
+		scope  string
+	}{
+		{
+			"regional", "arn:aws:s3:us-west-2:123456789012:accesspoint/myap", "",
+			"https://myap-123456789012.s3-accesspoint.us-west-2.amazonaws.com/key", "/us-west-2/s3/",
+		},
+		{
+			"region mismatch", "arn:aws:s3:us-west-2:123456789012:accesspoint/myap", "eu-west-1",
+			"https://myap-123456789012.s3-accesspoint.us-west-2.amazonaws.com/key", "/us-west-2/s3/",
+		},
+		{
+			"multi-region", "arn:aws:s3::123456789012:accesspoint/mfzwi23gnjvgw.mrap", "",
+			"https://mfzwi23gnjvgw.mrap.accesspoint.s3-global.amazonaws.com/key", "/s3/aws4_request",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("S3_BUCKET", test.bucket)
+			t.Setenv("AWS_REGION", test.region)
+			if err := checkAccessPoint(); err != nil {
+				t.Fatal(err)
+			}
+			client, err := createS3Client()
+			if err != nil {
+				t.Fatal(err)
+			}
+			recorder := &urlRecorder{}
+			client.HeadObject(context.Background(), &s3.HeadObjectInput{
+				Bucket: aws.String(test.bucket),
+				Key:    aws.String("key"),
+			}, func(o *s3.Options) {
+				o.HTTPClient = recorder
+				o.RetryMaxAttempts = 1
+			})
+			if len(recorder.urls) != 1 {
+				t.Fatalf("sent %d requests, want 1", len(recorder.urls))
+			}
+			if recorder.urls[0] != test.url {
+				t.Errorf("requested %s, want %s", recorder.urls[0], test.url)
+			}
+			if !strings.Contains(recorder.auths[0], test.scope) {
+				t.Errorf("signed with %s, want a scope with %s", recorder.auths[0], test.scope)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// auditRecord is written to the bucket for every upload when S3_AUDIT_PREFIX
+// is set.
+type auditRecord struct {
+	Oid       string `json:"oid"`
+	Size      int64  `json:"size"`
+	Timestamp string `json:"timestamp"`
+	Principal string `json:"principal"`
+}
+
+// writeAuditRecord stores a record of an upload as its own object under
+// S3_AUDIT_PREFIX, so records are never rewritten.
+func writeAuditRecord(ctx context.Context, oid string, size int64) error {
+	prefix, err := envExpanded("S3_AUDIT_PREFIX")
+	if err != nil || prefix == "" {
+		return err
+	}
+
+	client, err := getS3Client()
+	if err != nil {
+		return fmt.Errorf("creating client: %w", err)
+	}
+	creds, err := client.Options().Credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("retrieving credentials: %w", err)
+	}
+
+	now := time.Now().UTC()
+	record, err := json.Marshal(&auditRecord{
+		Oid:       oid,
+		Size:      size,
+		Timestamp: now.Format(time.RFC3339Nano),
+		Principal: creds.AccessKeyID,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Timestamped keys list in upload order.
+	key := path.Join(strings.Trim(prefix, "/"), now.Format("20060102T150405.000000000Z")+"-"+oid+".json")
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(os.Getenv("S3_BUCKET")),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(record),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
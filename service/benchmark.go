@@ -0,0 +1,157 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBenchmarkCount       = 10
+	defaultBenchmarkSize        = 16 * 1024 * 1024
+	defaultBenchmarkConcurrency = 4
+)
+
+// benchmarkObject is a random object used by the benchmark.
+type benchmarkObject struct {
+	oid  string
+	path string
+}
+
+// Benchmark uploads then downloads LFS_S3_BENCHMARK_COUNT random objects of
+// LFS_S3_BENCHMARK_SIZE bytes, LFS_S3_BENCHMARK_CONCURRENCY at a time,
+// through the same paths as real transfers. It prints the latency
+// percentiles and the aggregate throughput of each direction to stdout,
+// deletes the objects and returns false if any step failed.
+func Benchmark(stdout, stderr io.Writer) bool {
+	if err := checkConfig(); err != nil {
+		fmt.Fprintf(stdout, "Configuration error: %v\n", err)
+		return false
+	}
+	count, err := envInt64("LFS_S3_BENCHMARK_COUNT", defaultBenchmarkCount)
+	if err != nil || count < 1 {
+		fmt.Fprintf(stdout, "Configuration error: invalid LFS_S3_BENCHMARK_COUNT\n")
+		return false
+	}
+	size, err := envInt64("LFS_S3_BENCHMARK_SIZE", defaultBenchmarkSize)
+	if err != nil || size < 1 {
+		fmt.Fprintf(stdout, "Configuration error: invalid LFS_S3_BENCHMARK_SIZE\n")
+		return false
+	}
+	workers, err := envInt64("LFS_S3_BENCHMARK_CONCURRENCY", defaultBenchmarkConcurrency)
+	if err != nil || workers < 1 {
+		fmt.Fprintf(stdout, "Configuration error: invalid LFS_S3_BENCHMARK_CONCURRENCY\n")
+		return false
+	}
+
+	dir, err := os.MkdirTemp("", "lfs-s3-benchmark")
+	if err != nil {
+		fmt.Fprintf(stdout, "Unable to create temporary directory: %v\n", err)
+		return false
+	}
+	defer os.RemoveAll(dir)
+
+	objects := make([]benchmarkObject, count)
+	for i := range objects {
+		object, err := writeBenchmarkObject(dir, size)
+		if err != nil {
+			fmt.Fprintf(stdout, "Unable to write test content: %v\n", err)
+			return false
+		}
+		objects[i] = object
+	}
+	fmt.Fprintf(stdout, "Benchmarking %d objects of %d bytes, %d at a time\n", count, size, workers)
+
+	ctx := context.Background()
+	passed := runBenchmark(stdout, "upload", objects, size, int(workers), func(object benchmarkObject) error {
+		return uploadObject(ctx, object.oid, size, object.path, io.Discard, stderr)
+	})
+	if passed {
+		passed = runBenchmark(stdout, "download", objects, size, int(workers), func(object benchmarkObject) error {
+			return downloadObject(ctx, object.oid, size, object.path+".download", io.Discard, stderr)
+		})
+	}
+
+	// Always clean up, as some uploads may have succeeded.
+	for _, object := range objects {
+		if err := deleteObject(ctx, object.oid); err != nil {
+			fmt.Fprintf(stdout, "Error deleting %s: %s\n", object.oid, describeError(err))
+			passed = false
+		}
+	}
+	return passed
+}
+
+// writeBenchmarkObject writes size random bytes to a file of dir.
+func writeBenchmarkObject(dir string, size int64) (benchmarkObject, error) {
+	file, err := os.CreateTemp(dir, "object")
+	if err != nil {
+		return benchmarkObject{}, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(file, hash), rand.Reader, size); err != nil {
+		return benchmarkObject{}, err
+	}
+	return benchmarkObject{oid: hex.EncodeToString(hash.Sum(nil)), path: file.Name()}, file.Close()
+}
+
+// runBenchmark transfers every object with the given number of workers and
+// prints the results. It returns false if any transfer failed.
+func runBenchmark(stdout io.Writer, name string, objects []benchmarkObject, size int64, workers int, transfer func(benchmarkObject) error) bool {
+	queue := make(chan benchmarkObject)
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		failed    int
+		wg        sync.WaitGroup
+	)
+	start := time.Now()
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for object := range queue {
+				objectStart := time.Now()
+				err := transfer(object)
+				elapsed := time.Since(objectStart)
+
+				mu.Lock()
+				if err != nil {
+					failed++
+					fmt.Fprintf(stdout, "Error in %s of %s: %s\n", name, object.oid, describeError(err))
+				} else {
+					latencies = append(latencies, elapsed)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, object := range objects {
+		queue <- object
+	}
+	close(queue)
+	wg.Wait()
+	total := time.Since(start)
+
+	if len(latencies) > 0 {
+		slices.Sort(latencies)
+		percentile := func(p int) time.Duration {
+			return latencies[(len(latencies)-1)*p/100].Round(time.Millisecond)
+		}
+		throughput := float64(size) * float64(len(latencies)) / total.Seconds() / (1024 * 1024)
+		fmt.Fprintf(stdout, "%-10s p50 %v p90 %v p99 %v max %v, %.1f MiB/s\n",
+			name, percentile(50), percentile(90), percentile(99), percentile(100), throughput)
+	}
+	if failed > 0 {
+		fmt.Fprintf(stdout, "%-10s %d of %d failed\n", name, failed, len(objects))
+	}
+	return failed == 0
+}
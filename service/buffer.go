@@ -0,0 +1,168 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const defaultWriteBufferSize = 1024 * 1024
+
+// bufferedWriterAt batches contiguous writes to an io.WriterAt. A write
+// which does not follow the buffered data flushes it first, so the offsets
+// of concurrently downloaded parts are honored.
+type bufferedWriterAt struct {
+	mu     sync.Mutex
+	w      io.WriterAt
+	buf    []byte
+	offset int64 // Where buf starts in w
+}
+
+func newBufferedWriterAt(w io.WriterAt, size int) *bufferedWriterAt {
+	return &bufferedWriterAt{w: w, buf: make([]byte, 0, size)}
+}
+
+func (b *bufferedWriterAt) WriteAt(p []byte, off int64) (n int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.buf) > 0 && off != b.offset+int64(len(b.buf)) {
+		if err := b.flush(); err != nil {
+			return 0, err
+		}
+	}
+	if len(b.buf)+len(p) > cap(b.buf) {
+		if err := b.flush(); err != nil {
+			return 0, err
+		}
+		if len(p) >= cap(b.buf) {
+			return b.w.WriteAt(p, off)
+		}
+	}
+	if len(b.buf) == 0 {
+		b.offset = off
+	}
+	b.buf = append(b.buf, p...)
+	return len(p), nil
+}
+
+// Flush writes out any buffered data.
+func (b *bufferedWriterAt) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flush()
+}
+
+func (b *bufferedWriterAt) flush() error {
+	if len(b.buf) == 0 {
+		return nil
+	}
+	_, err := b.w.WriteAt(b.buf, b.offset)
+	b.buf = b.buf[:0]
+	return err
+}
+
+// boundedWriterAt refuses writes past limit bytes, so that an object larger
+// than lfs declared it can't fill up the disk.
+type boundedWriterAt struct {
+	w     io.WriterAt
+	limit int64
+}
+
+func (b *boundedWriterAt) WriteAt(p []byte, off int64) (n int, err error) {
+	if off+int64(len(p)) > b.limit {
+		return 0, fmt.Errorf("object is larger than its declared size of %d bytes", b.limit)
+	}
+	return b.w.WriteAt(p, off)
+}
+
+// diskWriteQueue returns S3_DISK_WRITE_QUEUE, the number of writes to a
+// downloaded file which may wait for the disk, or 0 to write synchronously.
+func diskWriteQueue() (int64, error) {
+	queue, err := envInt64("S3_DISK_WRITE_QUEUE", 0)
+	if err == nil && queue < 0 {
+		return 0, fmt.Errorf("S3_DISK_WRITE_QUEUE must not be negative")
+	}
+	return queue, err
+}
+
+// queuedWriterAt writes to an io.WriterAt from its own goroutine, through a
+// queue of bounded depth. Writes return once queued, and wait while the
+// queue is full, so that a disk slower than the network holds back the
+// part downloads, which stop reading their responses, instead of letting
+// data pile up in memory.
+type queuedWriterAt struct {
+	ctx       context.Context
+	writes    chan queuedWrite
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu  sync.Mutex
+	err error // The first error of the underlying writer
+}
+
+type queuedWrite struct {
+	p   []byte
+	off int64
+}
+
+// newQueuedWriterAt starts writing to w the writes queued, up to depth of
+// them at once, until ctx ends or Close is called.
+func newQueuedWriterAt(ctx context.Context, w io.WriterAt, depth int) *queuedWriterAt {
+	q := &queuedWriterAt{
+		ctx:    ctx,
+		writes: make(chan queuedWrite, depth),
+		done:   make(chan struct{}),
+	}
+	go q.run(w)
+	return q
+}
+
+func (q *queuedWriterAt) run(w io.WriterAt) {
+	defer close(q.done)
+	for write := range q.writes {
+		if q.failure() != nil || q.ctx.Err() != nil {
+			continue // Drop the rest of the queue
+		}
+		if _, err := w.WriteAt(write.p, write.off); err != nil {
+			q.mu.Lock()
+			q.err = err
+			q.mu.Unlock()
+		}
+	}
+}
+
+func (q *queuedWriterAt) failure() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.err
+}
+
+// WriteAt queues a copy of p, as callers reuse their buffers. An error of
+// an earlier write is returned instead.
+func (q *queuedWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if err := q.failure(); err != nil {
+		return 0, err
+	}
+	select {
+	case q.writes <- queuedWrite{p: bytes.Clone(p), off: off}:
+		return len(p), nil
+	case <-q.ctx.Done():
+		return 0, q.ctx.Err()
+	}
+}
+
+// Close waits for the queued writes to be done, and returns the first error
+// of the underlying writer. It stops waiting when the context ends, as the
+// disk may never catch up. No write may be queued after it.
+func (q *queuedWriterAt) Close() error {
+	q.closeOnce.Do(func() { close(q.writes) })
+	select {
+	case <-q.done:
+		return q.failure()
+	case <-q.ctx.Done():
+		return q.ctx.Err()
+	}
+}
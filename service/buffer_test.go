@@ -0,0 +1,104 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowWriterAt takes delay for every write, like a disk slower than the
+// network.
+type slowWriterAt struct {
+	mu      sync.Mutex
+	buf     []byte
+	delay   time.Duration
+	written atomic.Int64 // Writes done
+}
+
+func (w *slowWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	time.Sleep(w.delay)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	copy(w.buf[off:], p)
+	w.written.Add(1)
+	return len(p), nil
+}
+
+func TestQueuedWriterAtThrottles(t *testing.T) {
+	const depth, parts, writes, writeSize = 2, 4, 5, 4
+	data := bytes.Repeat([]byte("0123456789abcdef"), parts*writes*writeSize/16)
+	dst := &slowWriterAt{buf: make([]byte, len(data)), delay: 10 * time.Millisecond}
+	queue := newQueuedWriterAt(context.Background(), dst, depth)
+
+	// Parts downloaded concurrently write as they read their responses,
+	// and must be held back by the disk.
+	var queued atomic.Int64
+	var maxAhead atomic.Int64
+	var group sync.WaitGroup
+	for part := range parts {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			for i := range writes {
+				off := (part*writes + i) * writeSize
+				if _, err := queue.WriteAt(data[off:off+writeSize], int64(off)); err != nil {
+					t.Error(err)
+					return
+				}
+				ahead := queued.Add(1) - dst.written.Load()
+				for {
+					seen := maxAhead.Load()
+					if ahead <= seen || maxAhead.CompareAndSwap(seen, ahead) {
+						break
+					}
+				}
+			}
+		}()
+	}
+	group.Wait()
+	if err := queue.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dst.buf, data) {
+		t.Errorf("wrote %q, want %q", dst.buf, data)
+	}
+	// The queue and the write in progress are all the downloads may get
+	// ahead of the disk by.
+	if ahead := maxAhead.Load(); ahead > depth+1 {
+		t.Errorf("the downloads got %d writes ahead of the disk, want at most %d", ahead, depth+1)
+	}
+}
+
+func TestQueuedWriterAtCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	dst := &slowWriterAt{buf: make([]byte, 16), delay: time.Hour}
+	queue := newQueuedWriterAt(ctx, dst, 1)
+	// One write stuck on the disk, one queued.
+	for range 2 {
+		if _, err := queue.WriteAt([]byte("data"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := queue.WriteAt([]byte("data"), 4)
+		result <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Errorf("WriteAt error = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WriteAt still waits for the disk after the context ended")
+	}
+	if err := queue.Close(); err != context.Canceled {
+		t.Errorf("Close error = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Cat streams the object with the given oid to stdout, without writing it
+// to the LFS store. Errors go to stderr, and as the content is already out
+// by then, a content not matching the oid is only reported at the end. It
+// returns false if anything failed.
+func Cat(oid string, stdout, stderr io.Writer) bool {
+	if err := checkConfig(); err != nil {
+		fmt.Fprintf(stderr, "Configuration error: %v\n", err)
+		return false
+	}
+	if err := catObject(context.Background(), oid, stdout); err != nil {
+		fmt.Fprintf(stderr, "Error reading %s: %s\n", oid, describeError(err))
+		return false
+	}
+	return true
+}
+
+func catObject(ctx context.Context, oid string, stdout io.Writer) error {
+	client, err := getS3Client()
+	if err != nil {
+		return fmt.Errorf("creating client: %w", err)
+	}
+	key, err := locateKey(ctx, client, oid)
+	if err != nil {
+		return err
+	}
+	versionID, err := pinnedVersion(oid)
+	if err != nil {
+		return err
+	}
+	bucket := aws.String(os.Getenv("S3_BUCKET"))
+
+	hash := sha256.New()
+	output := io.MultiWriter(stdout, hash)
+	err = copyObject(ctx, client, &s3.GetObjectInput{Bucket: bucket, Key: aws.String(key), VersionId: versionID}, output)
+	if threshold, thresholdErr := compositeThreshold(); isNotFound(err) && thresholdErr == nil && threshold > 0 {
+		manifest, manifestErr := loadCompositeManifest(ctx, client, bucket, key)
+		if manifestErr == nil {
+			// Chunks are listed in order, so they can be streamed one by one.
+			for _, chunk := range manifest.Chunks {
+				if err = copyObject(ctx, client, &s3.GetObjectInput{Bucket: bucket, Key: aws.String(chunk.Key)}, output); err != nil {
+					break
+				}
+			}
+		} else if !isNotFound(manifestErr) {
+			err = manifestErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != oid {
+		return fmt.Errorf("content has oid %s, expected %s", got, oid)
+	}
+	return nil
+}
+
+// copyObject writes the object of input to w.
+func copyObject(ctx context.Context, client *s3.Client, input *s3.GetObjectInput, w io.Writer) error {
+	out, err := client.GetObject(ctx, input)
+	if err != nil {
+		return err
+	}
+	defer out.Body.Close()
+	_, err = io.Copy(w, out.Body)
+	return err
+}
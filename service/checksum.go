@@ -0,0 +1,97 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// useChecksums reports whether S3_CHECKSUM_SHA256 asks for SHA-256 object
+// checksums, which are stored along with uploads and checked on downloads.
+func useChecksums() bool {
+	return envBool("S3_CHECKSUM_SHA256")
+}
+
+// oidChecksum returns the oid as a base64 SHA-256 checksum, as S3 expects.
+func oidChecksum(oid string) (string, error) {
+	sum, err := hex.DecodeString(oid)
+	if err != nil {
+		return "", fmt.Errorf("invalid oid %s: %w", oid, err)
+	}
+	return base64.StdEncoding.EncodeToString(sum), nil
+}
+
+// setUploadChecksum has S3 check uploads with SHA-256. An object sent in a
+// single request is checked against its oid; a multipart upload can only
+// be checked part by part.
+func setUploadChecksum(input *s3.PutObjectInput, oid string, size int64, partSize int64) error {
+	if size > partSize {
+		input.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
+		return nil
+	}
+	checksum, err := oidChecksum(oid)
+	if err != nil {
+		return err
+	}
+	input.ChecksumSHA256 = aws.String(checksum)
+	return nil
+}
+
+// checkStoredChecksum compares the full object SHA-256 checksum S3 stored
+// for key, if any, with the oid. Objects uploaded in parts only have a
+// checksum of their part checksums, which can't be compared.
+func checkStoredChecksum(ctx context.Context, client *s3.Client, input *s3.GetObjectInput, oid string) error {
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       input.Bucket,
+		Key:          input.Key,
+		VersionId:    input.VersionId,
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
+	if err != nil {
+		return err
+	}
+	if head.ChecksumSHA256 == nil || head.ChecksumType == types.ChecksumTypeComposite {
+		return nil
+	}
+	expected, err := oidChecksum(oid)
+	if err != nil {
+		return err
+	}
+	if aws.ToString(head.ChecksumSHA256) != expected {
+		return fmt.Errorf("stored SHA-256 checksum %s of %s doesn't match its oid", aws.ToString(head.ChecksumSHA256), aws.ToString(input.Key))
+	}
+	return nil
+}
+
+// isChecksumError reports whether err is a 400 response about checksums,
+// such as those of endpoints not supporting checksum trailers. BadDigest
+// means the content itself didn't match, so it is not one of them.
+func isChecksumError(err error) bool {
+	var respErr *smithyhttp.ResponseError
+	if !errors.As(err, &respErr) || respErr.HTTPStatusCode() != 400 {
+		return false
+	}
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) || apiErr.ErrorCode() == "BadDigest" {
+		return false
+	}
+	description := strings.ToLower(apiErr.ErrorCode() + " " + apiErr.ErrorMessage())
+	return strings.Contains(description, "checksum") || strings.Contains(description, "trailer")
+}
+
+// withoutChecksums returns a copy of client which only sends checksums
+// when an operation requires them.
+func withoutChecksums(client *s3.Client) *s3.Client {
+	return s3.New(client.Options(), func(o *s3.Options) {
+		o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+	})
+}
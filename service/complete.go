@@ -0,0 +1,59 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go/middleware"
+)
+
+const (
+	defaultCompleteRetries = 3
+	completeRetryDelay     = time.Second
+	maxCompleteRetryDelay  = 30 * time.Second
+)
+
+// completeRetries returns S3_COMPLETE_RETRIES, how many more times a
+// CompleteMultipartUpload call is made once the retries of the SDK are used
+// up.
+func completeRetries() (int64, error) {
+	retries, err := envInt64("S3_COMPLETE_RETRIES", defaultCompleteRetries)
+	if err != nil {
+		return 0, err
+	}
+	if retries < 0 {
+		return 0, fmt.Errorf("S3_COMPLETE_RETRIES must not be negative")
+	}
+	return retries, nil
+}
+
+// withCompleteRetries adds a middleware retrying a failed
+// CompleteMultipartUpload call up to retries times, with a backoff from a
+// second up to 30 seconds. Completing the same parts again is idempotent,
+// and failing there would waste the whole upload.
+func withCompleteRetries(retries int64) func(*middleware.Stack) error {
+	retryable := retry.IsErrorRetryables(append(retryableCodes(), retry.DefaultRetryables...))
+	return func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("CompleteRetries", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			out, metadata, err := next.HandleInitialize(ctx, in)
+			if middleware.GetOperationName(ctx) != "CompleteMultipartUpload" {
+				return out, metadata, err
+			}
+			delay := completeRetryDelay
+			for attempt := int64(1); attempt <= retries && err != nil && retryable.IsErrorRetryable(err) == aws.TrueTernary; attempt++ {
+				fmt.Fprintf(DebugLog, "Retrying CompleteMultipartUpload in %v after: %v\n", delay, err)
+				select {
+				case <-ctx.Done():
+					return out, metadata, err
+				case <-time.After(delay):
+				}
+				delay = min(2*delay, maxCompleteRetryDelay)
+				out, metadata, err = next.HandleInitialize(ctx, in)
+			}
+			return out, metadata, err
+		}), middleware.After)
+	}
+}
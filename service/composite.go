@@ -0,0 +1,232 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	defaultCompositeChunks = 4
+	compositeSuffix        = ".composite"
+)
+
+// compositeManifest is stored next to the chunks of a composite object, in
+// place of the object itself.
+type compositeManifest struct {
+	Oid    string           `json:"oid"`
+	Size   int64            `json:"size"`
+	Chunks []compositeChunk `json:"chunks"`
+}
+
+// compositeChunk is a range of a composite object, stored as its own object.
+type compositeChunk struct {
+	Key    string `json:"key"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+// compositeThreshold returns S3_COMPOSITE_THRESHOLD, the size from which
+// objects are uploaded as S3_COMPOSITE_CHUNKS separate chunks, or 0 when
+// composite uploads are disabled.
+func compositeThreshold() (int64, error) {
+	threshold, err := envInt64("S3_COMPOSITE_THRESHOLD", 0)
+	if err != nil {
+		return 0, err
+	}
+	chunks, err := envInt64("S3_COMPOSITE_CHUNKS", defaultCompositeChunks)
+	if err != nil {
+		return 0, err
+	}
+	if chunks < 2 {
+		return 0, fmt.Errorf("S3_COMPOSITE_CHUNKS must be at least 2")
+	}
+	return threshold, nil
+}
+
+// reportingReader reports what is read through it to a shared tracker.
+type reportingReader struct {
+	io.Reader
+	progress *progressTracker
+}
+
+func (r *reportingReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	if n > 0 {
+		if reportErr := r.progress.report(n); reportErr != nil {
+			return n, reportErr
+		}
+	}
+	return
+}
+
+// compositeUpload uploads file as chunks sent concurrency at a time, each
+// one part at a time, then the manifest listing them. input holds the key
+// and settings of the object. Each chunk in flight holds one part buffer,
+// so the chunks take no more memory than an uploader of that concurrency.
+func compositeUpload(ctx context.Context, client *s3.Client, input *s3.PutObjectInput, file io.ReaderAt, oid string, size int64, partSize int64, concurrency int, progress *progressTracker) error {
+	count, err := envInt64("S3_COMPOSITE_CHUNKS", defaultCompositeChunks)
+	if err != nil {
+		return err
+	}
+	key := aws.ToString(input.Key)
+	chunkSize := (size + count - 1) / count
+	manifest := compositeManifest{Oid: oid, Size: size}
+	for offset, i := int64(0), 1; offset < size; offset, i = offset+chunkSize, i+1 {
+		manifest.Chunks = append(manifest.Chunks, compositeChunk{
+			Key:    fmt.Sprintf("%s.chunk%03d", key, i),
+			Offset: offset,
+			Size:   min(chunkSize, size-offset),
+		})
+	}
+
+	uploader := manager.NewUploader(client, func(u *manager.Uploader) {
+		u.PartSize = partSize
+		u.Concurrency = 1 // The chunks are the concurrency
+	})
+	var group errgroup.Group
+	group.SetLimit(concurrency)
+	for _, chunk := range manifest.Chunks {
+		chunkInput := *input
+		chunkInput.Key = aws.String(chunk.Key)
+		chunkInput.Body = &reportingReader{Reader: io.NewSectionReader(file, chunk.Offset, chunk.Size), progress: progress}
+		// A checksum or oid of the whole object doesn't apply to its chunks.
+		chunkInput.ChecksumSHA256 = nil
+		chunkInput.Metadata = nil
+		if useChecksums() {
+			chunkInput.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
+		}
+		group.Go(func() error {
+			if _, err := uploader.Upload(ctx, &chunkInput); err != nil {
+				return fmt.Errorf("uploading chunk %s: %w", chunk.Key, err)
+			}
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return err
+	}
+
+	// The manifest goes last, so that a composite object is never visible
+	// before all of its chunks are.
+	data, err := json.Marshal(&manifest)
+	if err != nil {
+		return err
+	}
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:               input.Bucket,
+		Key:                  aws.String(key + compositeSuffix),
+		Body:                 bytes.NewReader(data),
+		ContentType:          aws.String("application/json"),
+		Metadata:             input.Metadata,
+		IfNoneMatch:          input.IfNoneMatch,
+		ServerSideEncryption: input.ServerSideEncryption,
+		SSEKMSKeyId:          input.SSEKMSKeyId,
+	})
+	return err
+}
+
+// loadCompositeManifest fetches the manifest of the composite object at
+// key, returning a not found error if there is none.
+func loadCompositeManifest(ctx context.Context, client *s3.Client, bucket *string, key string) (*compositeManifest, error) {
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: bucket,
+		Key:    aws.String(key + compositeSuffix),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	var manifest compositeManifest
+	if err := json.NewDecoder(out.Body).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("reading manifest of %s: %w", key, err)
+	}
+	return &manifest, nil
+}
+
+// storedComposite returns the manifest of the composite object at key, or
+// nil when there is none or composite uploads are disabled.
+func storedComposite(ctx context.Context, client *s3.Client, bucket string, key string) (*compositeManifest, error) {
+	threshold, err := compositeThreshold()
+	if err != nil || threshold == 0 {
+		return nil, err
+	}
+	manifest, err := loadCompositeManifest(ctx, client, aws.String(bucket), key)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	return manifest, err
+}
+
+// offsetWriterAt writes at an offset of an underlying writer, so that a
+// chunk lands at its place in the object.
+type offsetWriterAt struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (o *offsetWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	return o.w.WriteAt(p, o.offset+off)
+}
+
+// downloadComposite reassembles the composite object of input into w when
+// there is one, reporting whether there was. notFound is returned when
+// there is no manifest either.
+func downloadComposite(ctx context.Context, client *s3.Client, downloader *manager.Downloader, input *s3.GetObjectInput, w io.WriterAt, notFound error) (bool, error) {
+	manifest, err := loadCompositeManifest(ctx, client, input.Bucket, aws.ToString(input.Key))
+	if isNotFound(err) {
+		return false, notFound
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var group errgroup.Group
+	for _, chunk := range manifest.Chunks {
+		group.Go(func() error {
+			_, err := downloader.Download(ctx, &offsetWriterAt{w: w, offset: chunk.Offset}, &s3.GetObjectInput{
+				Bucket:       input.Bucket,
+				Key:          aws.String(chunk.Key),
+				ChecksumMode: input.ChecksumMode,
+			})
+			if err != nil {
+				return fmt.Errorf("downloading chunk %s: %w", chunk.Key, err)
+			}
+			return nil
+		})
+	}
+	return true, group.Wait()
+}
+
+// deleteComposite removes the chunks and manifest of the composite object
+// at key, if there is one.
+func deleteComposite(ctx context.Context, client *s3.Client, key string) error {
+	bucket := aws.String(os.Getenv("S3_BUCKET"))
+	manifest, err := loadCompositeManifest(ctx, client, bucket, key)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, chunk := range manifest.Chunks {
+		_, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: bucket, Key: aws.String(chunk.Key)})
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+	_, err = client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: bucket, Key: aws.String(key + compositeSuffix)})
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCompositeUploadConcurrency(t *testing.T) {
+	fake := startFakeS3(t, "bucket")
+	fake.putDelay = 50 * time.Millisecond
+	t.Setenv("S3_COMPOSITE_THRESHOLD", "16")
+	t.Setenv("S3_COMPOSITE_CHUNKS", "6")
+	t.Setenv("S3_LARGE_OBJECT_THRESHOLD", "1")
+	t.Setenv("S3_LARGE_OBJECT_CONCURRENCY", "2")
+	unsetenv(t, "S3_PREFIX_DATE", "S3_SKIP_EXISTING")
+	t.Setenv("LFS_S3_OBJECTS_ROOT", t.TempDir())
+
+	data := bytes.Repeat([]byte("chunk "), 20)
+	sum := sha256.Sum256(data)
+	oid := hex.EncodeToString(sum[:])
+	src := filepath.Join(t.TempDir(), "src")
+	if err := os.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := uploadObject(context.Background(), oid, int64(len(data)), src, io.Discard, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if fake.puts != 7 {
+		t.Errorf("sent %d objects, want 6 chunks and a manifest", fake.puts)
+	}
+	if fake.maxInflight > 2 {
+		t.Errorf("sent %d chunks at once, more than the 2 parts reserved for", fake.maxInflight)
+	}
+}
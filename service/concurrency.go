@@ -0,0 +1,155 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"golang.org/x/sync/semaphore"
+)
+
+var (
+	requestSem     *semaphore.Weighted
+	requestLimit   int64
+	requestSemErr  error
+	requestSemOnce sync.Once
+)
+
+// globalConcurrency returns S3_GLOBAL_CONCURRENCY, the maximum number of S3
+// requests in flight across all transfers, or 0 when unlimited.
+func globalConcurrency() (int64, error) {
+	requestSemOnce.Do(func() {
+		requestLimit, requestSemErr = envInt64("S3_GLOBAL_CONCURRENCY", 0)
+		if requestSemErr == nil && requestLimit > 0 {
+			requestSem = semaphore.NewWeighted(requestLimit)
+		}
+	})
+	return requestLimit, requestSemErr
+}
+
+// transferConcurrency caps the part concurrency of a single transfer to the
+// global limit, when there is one.
+func transferConcurrency(concurrency int) int {
+	if limit, err := globalConcurrency(); err == nil && limit > 0 && int64(concurrency) > limit {
+		return int(limit)
+	}
+	return concurrency
+}
+
+const defaultLargeObjectConcurrency = 5
+
+// partConcurrency returns how many parts of an object of size bytes are
+// transferred at once. With S3_LARGE_OBJECT_THRESHOLD set, objects below it
+// go one part at a time, leaving parallelism to concurrent transfers, and
+// objects from it S3_LARGE_OBJECT_CONCURRENCY parts at a time. Otherwise it
+// is def.
+func partConcurrency(size int64, def int) (int, error) {
+	threshold, err := envInt64("S3_LARGE_OBJECT_THRESHOLD", 0)
+	if err != nil {
+		return 0, err
+	}
+	concurrency, err := envInt64("S3_LARGE_OBJECT_CONCURRENCY", defaultLargeObjectConcurrency)
+	if err != nil {
+		return 0, err
+	}
+	if concurrency < 1 {
+		return 0, fmt.Errorf("S3_LARGE_OBJECT_CONCURRENCY must be at least 1")
+	}
+	switch {
+	case threshold <= 0:
+		return transferConcurrency(def), nil
+	case size < threshold:
+		return 1, nil
+	default:
+		return transferConcurrency(int(concurrency)), nil
+	}
+}
+
+// limitedHTTPClient holds a slot of the global limit from the start of each
+// request until its response body is closed.
+type limitedHTTPClient struct {
+	client aws.HTTPClient
+	sem    *semaphore.Weighted
+}
+
+// concurrencyRamp returns S3_CONCURRENCY_RAMP, the time over which the
+// global limit grows from a single request to S3_GLOBAL_CONCURRENCY.
+func concurrencyRamp() (time.Duration, error) {
+	ramp, err := envDuration("S3_CONCURRENCY_RAMP", 0)
+	if err != nil {
+		return 0, err
+	}
+	if ramp > 0 {
+		if limit, err := globalConcurrency(); err != nil || limit <= 0 {
+			return 0, fmt.Errorf("S3_CONCURRENCY_RAMP requires S3_GLOBAL_CONCURRENCY")
+		}
+	}
+	return ramp, nil
+}
+
+var rampOnce sync.Once
+
+// startRamp holds back all but one slot of the global limit, and gives them
+// back evenly over the ramp, so that a burst of transfers doesn't trip the
+// rate limits of the endpoint.
+func startRamp(ramp time.Duration) {
+	rampOnce.Do(func() {
+		held := requestLimit - 1
+		if held <= 0 || !requestSem.TryAcquire(held) {
+			return
+		}
+		go func() {
+			ticker := time.NewTicker(ramp / time.Duration(held))
+			defer ticker.Stop()
+			for ; held > 0; held-- {
+				<-ticker.C
+				requestSem.Release(1)
+			}
+		}()
+	})
+}
+
+// limitRequests wraps client to honor S3_GLOBAL_CONCURRENCY.
+func limitRequests(client aws.HTTPClient) (aws.HTTPClient, error) {
+	if _, err := globalConcurrency(); err != nil {
+		return nil, err
+	}
+	ramp, err := concurrencyRamp()
+	if err != nil {
+		return nil, err
+	}
+	if requestSem == nil {
+		return client, nil
+	}
+	if ramp > 0 {
+		startRamp(ramp)
+	}
+	return &limitedHTTPClient{client: client, sem: requestSem}, nil
+}
+
+func (c *limitedHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	if err := c.sem.Acquire(req.Context(), 1); err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil || resp.Body == nil {
+		c.sem.Release(1)
+		return resp, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: sync.OnceFunc(func() { c.sem.Release(1) })}
+	return resp, nil
+}
+
+// releasingBody releases its request slot once closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	defer b.release()
+	return b.ReadCloser.Close()
+}
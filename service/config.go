@@ -0,0 +1,110 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envBool reads a boolean environment variable, treating anything which is
+// not a valid boolean as false.
+func envBool(name string) bool {
+	value, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		return false
+	}
+	return value
+}
+
+// envOptionalBool reads a boolean environment variable, returning nil when
+// it is not set so that the default can be told apart from an explicit false.
+func envOptionalBool(name string) (*bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil, nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid boolean %q in %s", value, name)
+	}
+	return &parsed, nil
+}
+
+// envInt64 reads an integer environment variable, returning def when it is
+// not set.
+func envInt64(name string, def int64) (int64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid integer %q in %s", value, name)
+	}
+	return parsed, nil
+}
+
+// envDuration reads a duration such as "30s" from the environment,
+// returning def when it is not set.
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q in %s", value, name)
+	}
+	return parsed, nil
+}
+
+// envFileMode reads octal permissions such as "0644" from the environment,
+// returning def when it is not set.
+func envFileMode(name string, def os.FileMode) (os.FileMode, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	parsed, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || parsed > 0777 {
+		return 0, fmt.Errorf("invalid octal permissions %q in %s", value, name)
+	}
+	return os.FileMode(parsed), nil
+}
+
+// expandEnv replaces the ${VAR} placeholders of a value with the matching
+// environment variables. Unlike os.ExpandEnv, an undefined variable is an
+// error rather than an empty string.
+func expandEnv(value string) (string, error) {
+	var expanded strings.Builder
+	for {
+		start := strings.Index(value, "${")
+		if start < 0 {
+			expanded.WriteString(value)
+			return expanded.String(), nil
+		}
+		end := strings.Index(value[start:], "}")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated placeholder in %q", value)
+		}
+		name := value[start+2 : start+end]
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s used in a placeholder is not defined", name)
+		}
+		expanded.WriteString(value[:start])
+		expanded.WriteString(env)
+		value = value[start+end+1:]
+	}
+}
+
+// envExpanded reads an environment variable and expands its placeholders.
+func envExpanded(name string) (string, error) {
+	value, err := expandEnv(os.Getenv(name))
+	if err != nil {
+		return "", fmt.Errorf("expanding %s: %w", name, err)
+	}
+	return value, nil
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// logConfig prints the effective configuration to stderr when
+// LFS_S3_LOG_CONFIG is set, to tell which settings were picked up. Secrets
+// are never printed, and access keys only by their last characters.
+func logConfig(stderr io.Writer) {
+	if !envBool("LFS_S3_LOG_CONFIG") {
+		return
+	}
+	client, err := getS3Client()
+	if err != nil {
+		fmt.Fprintf(stderr, "Configuration: unable to create the S3 client: %v\n", err)
+		return
+	}
+	options := client.Options()
+
+	endpoint := "resolved by the SDK"
+	if options.BaseEndpoint != nil {
+		endpoint = *options.BaseEndpoint
+	}
+	if endpoints, err := s3Endpoints(); err == nil && len(endpoints) > 1 {
+		endpoint = fmt.Sprintf("%v with failover", endpoints)
+	}
+	prefix, err := objectKeyPrefix()
+	if err != nil {
+		prefix = err.Error()
+	}
+	uploadSize, _ := uploadPartSize()
+	downloadSize, _ := downloadPartSize()
+	storageClass, _ := getStorageClass()
+	if storageClass == "" {
+		storageClass = "bucket default"
+	}
+	verifyMode, _ := getVerifyMode()
+
+	fmt.Fprintf(stderr, "Configuration: endpoint %s, bucket %s, region %s, path style %t\n", endpoint, os.Getenv("S3_BUCKET"), options.Region, options.UsePathStyle)
+	fmt.Fprintf(stderr, "Configuration: key prefix %s, storage class %s\n", prefix, storageClass)
+	fmt.Fprintf(stderr, "Configuration: upload parts of %d bytes, download parts of %d bytes\n", uploadSize, downloadSize)
+	fmt.Fprintf(stderr, "Configuration: encryption %s, SHA-256 checksums %t, verify %s\n", encryptionMode(), useChecksums(), verifyMode)
+	fmt.Fprintf(stderr, "Configuration: credentials %s\n", credentialSource())
+}
+
+// encryptionMode describes how uploads are encrypted.
+func encryptionMode() string {
+	switch {
+	case os.Getenv("S3_SSE_KMS_KEY_MAP") != "":
+		return "SSE-KMS with the keys of " + os.Getenv("S3_SSE_KMS_KEY_MAP")
+	case os.Getenv("S3_SSE_KMS_KEY_ID") != "":
+		return "SSE-KMS with key " + os.Getenv("S3_SSE_KMS_KEY_ID")
+	default:
+		return "bucket default"
+	}
+}
+
+// credentialSource describes where credentials come from, in the order
+// createS3Client picks them.
+func credentialSource() string {
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	switch {
+	case os.Getenv("AWS_PROFILE") != "":
+		return "from profile " + os.Getenv("AWS_PROFILE")
+	case accessKey != "" && os.Getenv("AWS_SECRET_ACCESS_KEY") != "":
+		return "from access key " + redact(accessKey)
+	case os.Getenv("S3_CREDENTIALS_JSON") != "":
+		return "from " + os.Getenv("S3_CREDENTIALS_JSON")
+	default:
+		return "from the default chain"
+	}
+}
+
+// redact hides all but the last 4 characters of value.
+func redact(value string) string {
+	if len(value) <= 4 {
+		return "****"
+	}
+	return "****" + value[len(value)-4:]
+}
@@ -0,0 +1,36 @@
+package service
+
+import (
+	"context"
+	"time"
+)
+
+// Backoff between reads of an object which isn't visible yet.
+const (
+	consistencyBackoff    = 100 * time.Millisecond
+	maxConsistencyBackoff = 5 * time.Second
+)
+
+// readAfterWrite runs read, retrying it up to S3_READ_CONSISTENCY_RETRIES
+// times with exponential backoff while the object is not found, for stores
+// where objects only become readable some time after their upload. AWS is
+// strongly consistent, so there are no retries by default.
+func readAfterWrite(ctx context.Context, read func() error) error {
+	retries, err := envInt64("S3_READ_CONSISTENCY_RETRIES", 0)
+	if err != nil {
+		return err
+	}
+	backoff := consistencyBackoff
+	for attempt := int64(0); ; attempt++ {
+		err := read()
+		if err == nil || attempt >= retries || !isNotFound(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxConsistencyBackoff)
+	}
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// defaultCredentialsJSONFields are the fields of S3_CREDENTIALS_JSON holding
+// the access key, secret key and session token, as exported by MinIO.
+const defaultCredentialsJSONFields = "accessKey,secretKey,sessionToken"
+
+// loadJSONCredentials reads the credentials in the JSON file named by
+// S3_CREDENTIALS_JSON. S3_CREDENTIALS_JSON_FIELDS names the access key,
+// secret key and optional session token fields, separated by commas, with
+// dots to reach into nested objects.
+func loadJSONCredentials() (aws.Credentials, error) {
+	path := os.Getenv("S3_CREDENTIALS_JSON")
+	fieldList := os.Getenv("S3_CREDENTIALS_JSON_FIELDS")
+	if fieldList == "" {
+		fieldList = defaultCredentialsJSONFields
+	}
+	fields := strings.Split(fieldList, ",")
+	if len(fields) < 2 || len(fields) > 3 {
+		return aws.Credentials{}, fmt.Errorf("S3_CREDENTIALS_JSON_FIELDS must name the access key, secret key and optionally session token fields")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("S3_CREDENTIALS_JSON: %w", err)
+	}
+	var document any
+	if err := json.Unmarshal(data, &document); err != nil {
+		return aws.Credentials{}, fmt.Errorf("S3_CREDENTIALS_JSON: %w", err)
+	}
+
+	values := make([]string, 3)
+	for i, field := range fields {
+		field = strings.TrimSpace(field)
+		value, ok := jsonField(document, field)
+		if !ok && i < 2 {
+			return aws.Credentials{}, fmt.Errorf("S3_CREDENTIALS_JSON: no string field %q in %s", field, path)
+		}
+		values[i] = value
+	}
+	return aws.Credentials{
+		AccessKeyID:     values[0],
+		SecretAccessKey: values[1],
+		SessionToken:    values[2],
+		Source:          "S3_CREDENTIALS_JSON",
+	}, nil
+}
+
+// jsonField looks up a dotted path of string field in a decoded document.
+func jsonField(document any, path string) (string, bool) {
+	for _, name := range strings.Split(path, ".") {
+		object, ok := document.(map[string]any)
+		if !ok {
+			return "", false
+		}
+		document = object[name]
+	}
+	value, ok := document.(string)
+	return value, ok && value != ""
+}
+
+// jsonCredentialsProvider reads S3_CREDENTIALS_JSON whenever the SDK needs
+// credentials.
+func jsonCredentialsProvider() aws.CredentialsProvider {
+	return aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+		return loadJSONCredentials()
+	})
+}
+
+// credentialRefreshWindow returns how long before their expiry cached
+// credentials are refreshed, from AWS_CREDENTIAL_REFRESH_WINDOW.
+func credentialRefreshWindow() (time.Duration, error) {
+	window, err := envDuration("AWS_CREDENTIAL_REFRESH_WINDOW", 0)
+	if err != nil {
+		return 0, err
+	}
+	if window < 0 {
+		return 0, fmt.Errorf("AWS_CREDENTIAL_REFRESH_WINDOW must not be negative")
+	}
+	return window, nil
+}
+
+// withRefreshWindow sets the refresh window of a credentials cache.
+func withRefreshWindow(window time.Duration) func(*aws.CredentialsCacheOptions) {
+	return func(o *aws.CredentialsCacheOptions) {
+		o.ExpiryWindow = window
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package service
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isCrossDevice reports whether a rename failed because its source and
+// destination are on different devices.
+func isCrossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
@@ -0,0 +1,177 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// dateKeys maps oids to their keys when S3_PREFIX_DATE is set, filled with a
+// single listing of the prefix and with the keys located or uploaded since.
+var (
+	dateKeysMu       sync.Mutex
+	dateKeys         map[string]string
+	dateKeysListedAt time.Time
+	dateKeysErr      error
+	dateKeysOnce     sync.Once
+)
+
+// usePrefixDate reports whether S3_PREFIX_DATE stores objects under a
+// YYYY/MM/DD/ segment of their upload date, for time based lifecycle rules.
+func usePrefixDate() bool {
+	return envBool("S3_PREFIX_DATE")
+}
+
+// uploadKey returns the key under which oid is uploaded now.
+func uploadKey(oid string) (string, error) {
+	if !usePrefixDate() {
+		return objectKey(oid)
+	}
+	prefix, err := objectKeyPrefix()
+	if err != nil {
+		return "", err
+	}
+	suffix, err := keySuffix()
+	if err != nil {
+		return "", err
+	}
+	key := path.Join(prefix, time.Now().UTC().Format("2006/01/02"), oid+suffix)
+	if err := validateKey(key); err != nil {
+		return "", err
+	}
+
+	dateKeysMu.Lock()
+	defer dateKeysMu.Unlock()
+	if dateKeys == nil {
+		dateKeys = map[string]string{}
+	}
+	dateKeys[oid] = key
+	return key, nil
+}
+
+// locateKey returns the key holding oid. With S3_PREFIX_DATE, the date of
+// an object is not known up front, so the prefix is listed once to find
+// the keys of all objects. Objects missing from it may have been uploaded
+// by other clients since, under the dates from then on, and are otherwise
+// looked up where they would be without a date.
+func locateKey(ctx context.Context, client *s3.Client, oid string) (string, error) {
+	if !usePrefixDate() {
+		return objectKey(oid)
+	}
+
+	if key, ok := cachedDateKey(oid); ok {
+		return key, nil
+	}
+	dateKeysOnce.Do(func() {
+		dateKeysErr = listDateKeys(ctx, client)
+	})
+	if dateKeysErr != nil {
+		return "", dateKeysErr
+	}
+	if key, ok := cachedDateKey(oid); ok {
+		return key, nil
+	}
+
+	key, found, err := findDateKey(ctx, client, oid)
+	if err != nil || found {
+		return key, err
+	}
+	return objectKey(oid)
+}
+
+// cachedDateKey returns the key of oid found so far, if any.
+func cachedDateKey(oid string) (string, bool) {
+	dateKeysMu.Lock()
+	defer dateKeysMu.Unlock()
+	key, ok := dateKeys[oid]
+	return key, ok
+}
+
+// findDateKey looks for oid under each date from the listing of the prefix
+// to today, newest first, and adds the key holding it to dateKeys.
+func findDateKey(ctx context.Context, client *s3.Client, oid string) (string, bool, error) {
+	prefix, err := objectKeyPrefix()
+	if err != nil {
+		return "", false, err
+	}
+	suffix, err := keySuffix()
+	if err != nil {
+		return "", false, err
+	}
+	dateKeysMu.Lock()
+	listedAt := dateKeysListedAt
+	dateKeysMu.Unlock()
+
+	first := listedAt.Truncate(24 * time.Hour)
+	for day := time.Now().UTC(); !day.Before(first); day = day.AddDate(0, 0, -1) {
+		key := path.Join(prefix, day.Format("2006/01/02"), oid+suffix)
+		_, found, err := storedObjectSize(ctx, client, os.Getenv("S3_BUCKET"), key)
+		if err != nil {
+			return "", false, err
+		}
+		if found {
+			dateKeysMu.Lock()
+			dateKeys[oid] = key
+			dateKeysMu.Unlock()
+			return key, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// listDateKeys adds every object under the prefix to dateKeys. The listing
+// is done without holding dateKeysMu, so that uploads don't wait for it.
+func listDateKeys(ctx context.Context, client *s3.Client) error {
+	prefix, err := objectKeyPrefix()
+	if err != nil {
+		return err
+	}
+	suffix, err := keySuffix()
+	if err != nil {
+		return err
+	}
+	pageSize, err := listPageSize()
+	if err != nil {
+		return err
+	}
+	listedAt := time.Now().UTC()
+	keys := map[string]string{}
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket:  aws.String(os.Getenv("S3_BUCKET")),
+		Prefix:  aws.String(prefix),
+		MaxKeys: pageSize,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, object := range page.Contents {
+			// A composite object is found by its manifest, and kept under
+			// the key of the object itself.
+			key := strings.TrimSuffix(aws.ToString(object.Key), compositeSuffix)
+			if oid, ok := strings.CutSuffix(path.Base(key), suffix); ok && len(oid) == 64 {
+				keys[oid] = key
+			}
+		}
+	}
+
+	dateKeysMu.Lock()
+	defer dateKeysMu.Unlock()
+	if dateKeys == nil {
+		dateKeys = map[string]string{}
+	}
+	for oid, key := range keys {
+		if _, ok := dateKeys[oid]; !ok {
+			dateKeys[oid] = key
+		}
+	}
+	dateKeysListedAt = listedAt
+	return nil
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var datedKey = regexp.MustCompile(`/\d{4}/\d{2}/\d{2}/[0-9a-f]{64}`)
+
+// forgetDateKeys drops the keys located so far, as a new process would.
+func forgetDateKeys() {
+	dateKeysMu.Lock()
+	dateKeys = nil
+	dateKeysListedAt = time.Time{}
+	dateKeysErr = nil
+	dateKeysOnce = sync.Once{}
+	dateKeysMu.Unlock()
+}
+
+func TestPrefixDateComposite(t *testing.T) {
+	for _, suffix := range []string{"", ".bin"} {
+		t.Run("suffix="+suffix, func(t *testing.T) {
+			fake := startFakeS3(t, "bucket")
+			t.Setenv("S3_PREFIX_DATE", "true")
+			t.Setenv("S3_KEY_SUFFIX", suffix)
+			t.Setenv("S3_COMPOSITE_THRESHOLD", "16")
+			t.Setenv("S3_COMPOSITE_CHUNKS", "2")
+			t.Setenv("LFS_S3_OBJECTS_ROOT", t.TempDir())
+			forgetDateKeys()
+			t.Cleanup(forgetDateKeys)
+
+			data := bytes.Repeat([]byte("composite "), 10)
+			sum := sha256.Sum256(data)
+			oid := hex.EncodeToString(sum[:])
+			src := filepath.Join(t.TempDir(), "src")
+			if err := os.WriteFile(src, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			if err := uploadObject(ctx, oid, int64(len(data)), src, io.Discard, io.Discard); err != nil {
+				t.Fatal(err)
+			}
+			var manifest string
+			for _, key := range fake.keys() {
+				if strings.HasSuffix(key, oid+suffix+compositeSuffix) {
+					manifest = key
+				}
+			}
+			if !datedKey.MatchString(manifest) {
+				t.Fatalf("stored %v, want a manifest under a date", fake.keys())
+			}
+
+			forgetDateKeys()
+			client, err := getS3Client()
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, err := locateKey(ctx, client, oid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key+compositeSuffix != manifest {
+				t.Errorf("located %s, want the key of %s", key, manifest)
+			}
+			exists, err := objectExists(ctx, client, "bucket", key, oid, int64(len(data)), src)
+			if err != nil || !exists {
+				t.Errorf("objectExists = %v, %v, want true", exists, err)
+			}
+
+			forgetDateKeys()
+			dst := filepath.Join(t.TempDir(), "dst")
+			if err := downloadObject(ctx, oid, int64(len(data)), dst, io.Discard, io.Discard); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("downloaded %q, want %q", got, data)
+			}
+		})
+	}
+}
+
+func TestPrefixDateUploadedSinceListing(t *testing.T) {
+	fake := startFakeS3(t, "bucket")
+	t.Setenv("S3_PREFIX_DATE", "true")
+	t.Setenv("S3_PREFIX", "lfs")
+	forgetDateKeys()
+	t.Cleanup(forgetDateKeys)
+
+	ctx := context.Background()
+	client, err := getS3Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := strings.Repeat("a", 64)
+	fake.put("lfs/2024/01/02/"+listed, []byte("listed"), nil)
+	if key, err := locateKey(ctx, client, listed); err != nil || key != "lfs/2024/01/02/"+listed {
+		t.Fatalf("locateKey = %s, %v, want the listed key", key, err)
+	}
+
+	// Another client pushes an object after the listing.
+	pushed := strings.Repeat("b", 64)
+	want := "lfs/" + time.Now().UTC().Format("2006/01/02") + "/" + pushed
+	fake.put(want, []byte("pushed"), nil)
+	if key, err := locateKey(ctx, client, pushed); err != nil || key != want {
+		t.Errorf("locateKey = %s, %v, want %s", key, err, want)
+	}
+	if fake.lists != 1 {
+		t.Errorf("listed the prefix %d times, want once", fake.lists)
+	}
+
+	missing := strings.Repeat("c", 64)
+	if key, err := locateKey(ctx, client, missing); err != nil || key != "lfs/"+missing {
+		t.Errorf("locateKey = %s, %v, want the key without a date", key, err)
+	}
+}
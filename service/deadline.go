@@ -0,0 +1,30 @@
+package service
+
+import (
+	"context"
+	"time"
+)
+
+const defaultTransferBaseline = 30 * time.Second
+
+// transferContext bounds a transfer of size bytes when S3_MIN_RATE is set,
+// giving it S3_TRANSFER_BASELINE plus the time needed to move its bytes at
+// that many bytes per second. Large objects get proportionally more time,
+// while stalls on small ones still fail fast.
+func transferContext(ctx context.Context, size int64) (context.Context, context.CancelFunc, error) {
+	minRate, err := envInt64("S3_MIN_RATE", 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	baseline, err := envDuration("S3_TRANSFER_BASELINE", defaultTransferBaseline)
+	if err != nil {
+		return nil, nil, err
+	}
+	if minRate <= 0 {
+		ctx, cancel := context.WithCancel(ctx)
+		return ctx, cancel, nil
+	}
+	timeout := baseline + time.Duration(float64(size)/float64(minRate)*float64(time.Second))
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, cancel, nil
+}
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// deleteObject removes the object with the given oid from the bucket. An
+// object which is already gone is not an error.
+func deleteObject(ctx context.Context, oid string) error {
+	client, err := getS3Client()
+	if err != nil {
+		return fmt.Errorf("creating client: %w", err)
+	}
+	key, err := locateKey(ctx, client, oid)
+	if err != nil {
+		return err
+	}
+	_, err = client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(os.Getenv("S3_BUCKET")),
+		Key:    aws.String(key),
+	})
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	if threshold, err := compositeThreshold(); err != nil || threshold == 0 {
+		return err
+	}
+	return deleteComposite(ctx, client, key)
+}
+
+// Delete removes the objects with the given oids from the bucket, printing
+// each deleted oid to stdout. It returns false if any deletion failed.
+func Delete(oids []string, stdout, stderr io.Writer) bool {
+	if err := checkConfig(); err != nil {
+		fmt.Fprintf(stdout, "Configuration error: %v\n", err)
+		return false
+	}
+
+	ctx := context.Background()
+	ok := true
+	for _, oid := range oids {
+		if err := deleteObject(ctx, oid); err != nil {
+			fmt.Fprintf(stdout, "Error deleting %s: %s\n", oid, describeError(err))
+			ok = false
+			continue
+		}
+		fmt.Fprintf(stdout, "Deleted %s\n", oid)
+	}
+	return ok
+}
@@ -0,0 +1,22 @@
+package service
+
+import (
+	"fmt"
+)
+
+// checkDiskSpace fails when S3_CHECK_DISK_SPACE is set and the filesystem
+// of dir has less than size bytes available, rather than filling it up
+// partway through the download.
+func checkDiskSpace(dir string, size int64) error {
+	if !envBool("S3_CHECK_DISK_SPACE") || size <= 0 {
+		return nil
+	}
+	available, err := availableSpace(dir)
+	if err != nil {
+		return fmt.Errorf("checking free disk space in %s: %w", dir, err)
+	}
+	if available < uint64(size) {
+		return fmt.Errorf("not enough disk space in %s for %d bytes, %d available", dir, size, available)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package service
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// regionLabel matches the region in endpoint host names such as
+// s3.eu-west-1.amazonaws.com or s3.us-west-004.backblazeb2.com.
+var regionLabel = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-\d+$`)
+
+// s3Endpoint returns the endpoint set in AWS_S3_ENDPOINT, or the first one
+// of AWS_S3_ENDPOINTS, or nil to let the SDK resolve it, from
+// AWS_ENDPOINT_URL_S3 for instance. A path is kept, for gateways mounted
+// under one such as https://host/s3/, and bucket and key are added after it
+// with either addressing style.
+func s3Endpoint() (*string, error) {
+	endpoints, err := s3Endpoints()
+	if err != nil {
+		return nil, err
+	}
+	if len(endpoints) > 0 {
+		return &endpoints[0], nil
+	}
+	value := os.Getenv("AWS_S3_ENDPOINT")
+	if value == "" {
+		return nil, nil
+	}
+	endpoint, err := parseEndpoint("AWS_S3_ENDPOINT", value)
+	if err != nil {
+		return nil, err
+	}
+	return &endpoint, nil
+}
+
+// parseEndpoint checks an endpoint URL read from the variable name, and
+// returns it without its trailing slash.
+func parseEndpoint(name string, value string) (string, error) {
+	endpoint, err := url.Parse(value)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return "", fmt.Errorf("invalid endpoint %q in %s, expected an http or https URL", value, name)
+	}
+	if endpoint.RawQuery != "" || endpoint.Fragment != "" {
+		return "", fmt.Errorf("invalid endpoint %q in %s, it can't have a query or fragment", value, name)
+	}
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/")
+	endpoint.RawPath = ""
+	return endpoint.String(), nil
+}
+
+// endpointRegion returns the region named in the host of the endpoint,
+// from AWS_S3_ENDPOINT, AWS_S3_ENDPOINTS or else the SDK variables, or an
+// empty string.
+func endpointRegion() string {
+	value := os.Getenv("AWS_S3_ENDPOINT")
+	if value == "" {
+		value, _, _ = strings.Cut(os.Getenv("AWS_S3_ENDPOINTS"), ",")
+	}
+	for _, name := range []string{"AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"} {
+		if value == "" {
+			value = os.Getenv(name)
+		}
+	}
+	endpoint, err := url.Parse(value)
+	if err != nil {
+		return ""
+	}
+	for _, label := range strings.Split(endpoint.Hostname(), ".") {
+		label = strings.TrimPrefix(label, "s3-")
+		if regionLabel.MatchString(label) {
+			return label
+		}
+	}
+	return ""
+}
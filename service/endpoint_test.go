@@ -0,0 +1,80 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		ok    bool
+	}{
+		{"https://s3.example.com", "https://s3.example.com", true},
+		{"https://gateway.example.com/s3/", "https://gateway.example.com/s3", true},
+		{"http://localhost:9000/tenant/s3", "http://localhost:9000/tenant/s3", true},
+		{"s3.example.com", "", false},
+		{"ftp://s3.example.com", "", false},
+		{"https://s3.example.com/?region=x", "", false},
+	}
+	for _, test := range tests {
+		got, err := parseEndpoint("AWS_S3_ENDPOINT", test.value)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("parseEndpoint(%q) = %q, %v, want %q", test.value, got, err, test.want)
+		}
+	}
+}
+
+// urlRecorder records the URL of the requests without their query, and
+// their authorization header, and does not send them.
+type urlRecorder struct {
+	urls  []string
+	auths []string
+}
+
+func (r *urlRecorder) Do(req *http.Request) (*http.Response, error) {
+	u := *req.URL
+	u.RawQuery = ""
+	r.urls = append(r.urls, u.String())
+	r.auths = append(r.auths, req.Header.Get("Authorization"))
+	return nil, errors.New("not sent")
+}
+
+func TestSubPathEndpoint(t *testing.T) {
+	unsetenv(t, "AWS_CA_BUNDLE", "AWS_S3_ENDPOINTS", "AWS_PROFILE")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_S3_ENDPOINT", "https://gateway.example.com/s3/")
+	tests := []struct {
+		pathStyle string
+		want      string
+	}{
+		{"true", "https://gateway.example.com/s3/bucket/key"},
+		{"false", "https://bucket.gateway.example.com/s3/key"},
+	}
+	for _, test := range tests {
+		t.Setenv("S3_USEPATHSTYLE", test.pathStyle)
+		client, err := createS3Client()
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := &urlRecorder{}
+		client.GetObject(context.Background(), &s3.GetObjectInput{
+			Bucket: aws.String("bucket"),
+			Key:    aws.String("key"),
+		}, func(o *s3.Options) {
+			o.HTTPClient = recorder
+			o.RetryMaxAttempts = 1
+		})
+		if len(recorder.urls) != 1 || recorder.urls[0] != test.want {
+			t.Errorf("with S3_USEPATHSTYLE=%s requested %v, want %s", test.pathStyle, recorder.urls, test.want)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/aws/smithy-go"
+
+	"git.sr.ht/~ngraves/lfs-s3/api"
+)
+
+// errorHints maps common S3 error codes to guidance for the user.
+var errorHints = map[string]string{
+	"AccessDenied":          "check that your credentials are allowed to access the bucket",
+	"InvalidAccessKeyId":    "check AWS_ACCESS_KEY_ID or your AWS profile",
+	"InvalidObjectState":    "the object is archived, restore it or set S3_AUTO_RESTORE=true",
+	"NoSuchBucket":          "check S3_BUCKET and that the bucket exists in AWS_REGION",
+	"NoSuchKey":             "the object is missing from the bucket, was it ever pushed?",
+	"PermanentRedirect":     "check AWS_REGION, the bucket is in another region",
+	"NotFound":              "the object is missing from the bucket, was it ever pushed?",
+	"RequestTimeTooSkewed":  "check your system clock, it is too far from the server time",
+	"SignatureDoesNotMatch": "check AWS_SECRET_ACCESS_KEY and AWS_REGION",
+}
+
+// errorHint returns guidance for a known S3 error, or an empty string.
+func errorHint(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		if apiErr.ErrorCode() == "AccessDenied" && os.Getenv("S3_EXPECTED_BUCKET_OWNER") != "" {
+			return "bucket ownership mismatch, possible misconfiguration or takeover, check that S3_EXPECTED_BUCKET_OWNER owns S3_BUCKET, or your credentials"
+		}
+		return errorHints[apiErr.ErrorCode()]
+	}
+	if errors.Is(err, context.DeadlineExceeded) && os.Getenv("S3_MIN_RATE") != "" {
+		return "the transfer was slower than S3_MIN_RATE allows"
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return "could not resolve the endpoint, check it and your DNS, or raise S3_DNS_TIMEOUT"
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return "could not connect to the endpoint, check it and your network, or raise S3_DIAL_TIMEOUT"
+	}
+	if strings.Contains(err.Error(), "TLS handshake timeout") {
+		return "the endpoint did not complete the TLS handshake, check it or raise S3_TLS_HANDSHAKE_TIMEOUT"
+	}
+	return ""
+}
+
+// hasErrorCode reports whether err is an S3 error with one of the codes.
+func hasErrorCode(err error, codes ...string) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		for _, code := range codes {
+			if apiErr.ErrorCode() == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isNotFound reports whether err means the object or upload does not exist.
+func isNotFound(err error) bool {
+	return hasErrorCode(err, "NoSuchKey", "NotFound", "NoSuchUpload")
+}
+
+// describeError formats an error along with its hint, if any.
+func describeError(err error) string {
+	if hint := errorHint(err); hint != "" {
+		return fmt.Sprintf("%v (%s)", err, hint)
+	}
+	return err.Error()
+}
+
+// sendTransferError logs a failed transfer and reports it back to lfs,
+// unless the request was already answered.
+func sendTransferError(oid string, context string, err error, writer io.Writer, stderr io.Writer) {
+	message := fmt.Sprintf("%s: %s", context, describeError(err))
+	fmt.Fprintf(stderr, "%s\n", message)
+	if !claimTerminal(oid, writer, stderr) {
+		return
+	}
+	api.SendTransferError(oid, 1, message, writer, stderr)
+}
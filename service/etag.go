@@ -0,0 +1,29 @@
+package service
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// checkETag compares the ETag returned for an upload with the MD5 of the
+// uploaded content. Only the ETag of a single part upload without KMS
+// encryption is an MD5, other uploads are not checked.
+func checkETag(out *manager.UploadOutput, md5sum []byte) error {
+	if out.UploadID != "" {
+		return nil
+	}
+	switch out.ServerSideEncryption {
+	case types.ServerSideEncryptionAwsKms, types.ServerSideEncryptionAwsKmsDsse:
+		return nil
+	}
+	etag := strings.Trim(aws.ToString(out.ETag), `"`)
+	if expected := hex.EncodeToString(md5sum); etag != expected {
+		return fmt.Errorf("uploaded object has ETag %s, expected MD5 %s", etag, expected)
+	}
+	return nil
+}
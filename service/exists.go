@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Metadata keys under which S3_STORE_OID_METADATA stores the oid and size
+// of objects, sent as x-amz-meta-sha256 and x-amz-meta-size.
+const (
+	oidMetadata  = "sha256"
+	sizeMetadata = "size"
+)
+
+// oidMetadataOf returns the metadata describing the object oid.
+func oidMetadataOf(oid string, size int64) map[string]string {
+	return map[string]string{
+		oidMetadata:  oid,
+		sizeMetadata: strconv.FormatInt(size, 10),
+	}
+}
+
+// objectExists reports whether the latest version of key already holds the
+// object oid. A stored object of the same size may still be truncated or
+// corrupted, so it only counts when its full object SHA-256 checksum, the
+// oid in its metadata or the ETag of a single part upload, an MD5 of its
+// content, matches the file at localPath.
+func objectExists(ctx context.Context, client *s3.Client, bucket string, key string, oid string, size int64, localPath string) (bool, error) {
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key),
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
+	if isNotFound(err) {
+		manifest, err := storedComposite(ctx, client, bucket, key)
+		if err != nil || manifest == nil {
+			return false, err
+		}
+		return manifest.Oid == oid && manifest.Size == size, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if aws.ToInt64(head.ContentLength) != size {
+		return false, nil
+	}
+
+	if head.ChecksumSHA256 != nil && head.ChecksumType != types.ChecksumTypeComposite {
+		expected, err := oidChecksum(oid)
+		if err != nil {
+			return false, err
+		}
+		return aws.ToString(head.ChecksumSHA256) == expected, nil
+	}
+	if stored, ok := head.Metadata[oidMetadata]; ok {
+		return stored == oid, nil
+	}
+	// The ETag of multipart uploads, and of objects encrypted with KMS or
+	// customer keys, isn't an MD5 of their content.
+	etag := strings.Trim(aws.ToString(head.ETag), `"`)
+	if etag == "" || strings.Contains(etag, "-") || head.SSECustomerAlgorithm != nil {
+		return false, nil
+	}
+	switch head.ServerSideEncryption {
+	case types.ServerSideEncryptionAwsKms, types.ServerSideEncryptionAwsKmsDsse:
+		return false, nil
+	}
+	sum, err := fileMD5(localPath)
+	if err != nil {
+		return false, err
+	}
+	return etag == hex.EncodeToString(sum), nil
+}
+
+// fileMD5 returns the MD5 of the file at path.
+func fileMD5(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// storedObjectSize returns the size of the latest version of key, or of
+// the composite object stored there, and whether there is one.
+func storedObjectSize(ctx context.Context, client *s3.Client, bucket string, key string) (int64, bool, error) {
+	head, err := headStoredObject(ctx, client, bucket, key)
+	if err != nil {
+		return 0, false, err
+	}
+	if head != nil {
+		return aws.ToInt64(head.ContentLength), true, nil
+	}
+	manifest, err := storedComposite(ctx, client, bucket, key)
+	if err != nil || manifest == nil {
+		return 0, false, err
+	}
+	return manifest.Size, true, nil
+}
+
+// headStoredObject returns the metadata of the latest version of key, or
+// nil when there is none.
+func headStoredObject(ctx context.Context, client *s3.Client, bucket string, key string) (*s3.HeadObjectOutput, error) {
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if isNotFound(err) {
+		return nil, nil
+	}
+	return head, err
+}
@@ -0,0 +1,55 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSkipExisting(t *testing.T) {
+	data := []byte("the content of the object")
+	sum := sha256.Sum256(data)
+	oid := hex.EncodeToString(sum[:])
+	corrupted := bytes.ToUpper(data)
+
+	tests := []struct {
+		name   string
+		stored []byte
+		header http.Header
+		skip   bool
+	}{
+		{"same content", data, nil, true},
+		{"same size, other content", corrupted, nil, false},
+		{"oid metadata", corrupted, http.Header{"X-Amz-Meta-Sha256": {oid}, "Etag": {`"abc-2"`}}, true},
+		{"other oid metadata", data, http.Header{"X-Amz-Meta-Sha256": {oid[1:] + "0"}}, false},
+		{"multipart ETag", data, http.Header{"Etag": {`"abc-2"`}}, false},
+		{"truncated", data[1:], nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := startFakeS3(t, "bucket")
+			t.Setenv("S3_PREFIX", "lfs")
+			t.Setenv("S3_SKIP_EXISTING", "true")
+			unsetenv(t, "S3_SKIP_EXISTING_CHECKSUM", "S3_PREFIX_DATE", "S3_COMPOSITE_THRESHOLD")
+			t.Setenv("LFS_S3_OBJECTS_ROOT", t.TempDir())
+			src := filepath.Join(t.TempDir(), "src")
+			if err := os.WriteFile(src, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			fake.put("lfs/"+oid, test.stored, test.header)
+
+			if err := uploadObject(context.Background(), oid, int64(len(data)), src, io.Discard, io.Discard); err != nil {
+				t.Fatal(err)
+			}
+			if skipped := fake.puts == 0; skipped != test.skip {
+				t.Errorf("skipped the upload: %v, want %v", skipped, test.skip)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Directory bucket names end with the availability zone id, as in
+// "bucket-base-name--usw2-az1--x-s3".
+const expressBucketSuffix = "--x-s3"
+
+// useS3Express reports whether S3_EXPRESS asks for S3 Express One Zone
+// directory bucket settings.
+func useS3Express() bool {
+	return envBool("S3_EXPRESS")
+}
+
+// checkS3Express validates the configuration for a directory bucket.
+func checkS3Express() error {
+	if !useS3Express() {
+		return nil
+	}
+	bucket := os.Getenv("S3_BUCKET")
+	if !strings.HasSuffix(bucket, expressBucketSuffix) || strings.Count(bucket, "--") < 2 {
+		return fmt.Errorf("S3_EXPRESS requires a directory bucket named <name>--<az-id>%s, got %s", expressBucketSuffix, bucket)
+	}
+	if envBool("S3_USEPATHSTYLE") {
+		return fmt.Errorf("S3_EXPRESS directory buckets do not support S3_USEPATHSTYLE")
+	}
+	class, err := getStorageClass()
+	if err != nil {
+		return err
+	}
+	if class != "" && class != types.StorageClassExpressOnezone {
+		return fmt.Errorf("S3_EXPRESS directory buckets only support the %s storage class, got %s", types.StorageClassExpressOnezone, class)
+	}
+	return nil
+}
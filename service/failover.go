@@ -0,0 +1,103 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	smithyendpoints "github.com/aws/smithy-go/endpoints"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// endpointFailover rotates through the endpoints of AWS_S3_ENDPOINTS. All
+// requests go to the current endpoint, and the next one takes over when
+// connecting to it fails. The SDK retries such failures, so the retry
+// reaches the next endpoint.
+type endpointFailover struct {
+	endpoints []string
+	current   atomic.Int64
+}
+
+// s3Endpoints returns the endpoints listed in AWS_S3_ENDPOINTS, separated by
+// commas, or nil when it is not set.
+func s3Endpoints() ([]string, error) {
+	value := os.Getenv("AWS_S3_ENDPOINTS")
+	if value == "" {
+		return nil, nil
+	}
+	if os.Getenv("AWS_S3_ENDPOINT") != "" {
+		return nil, fmt.Errorf("AWS_S3_ENDPOINT and AWS_S3_ENDPOINTS can't both be set")
+	}
+	var endpoints []string
+	for _, endpoint := range strings.Split(value, ",") {
+		parsed, err := parseEndpoint("AWS_S3_ENDPOINTS", strings.TrimSpace(endpoint))
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, parsed)
+	}
+	return endpoints, nil
+}
+
+// endpoint returns the endpoint requests currently go to.
+func (f *endpointFailover) endpoint() string {
+	return f.endpoints[f.current.Load()%int64(len(f.endpoints))]
+}
+
+// fail moves on to the next endpoint after failing to connect to host,
+// unless another request already did.
+func (f *endpointFailover) fail(host string) {
+	current := f.current.Load()
+	endpoint, err := url.Parse(f.endpoints[current%int64(len(f.endpoints))])
+	if err != nil {
+		return
+	}
+	// Virtual-hosted requests go to a subdomain of the endpoint.
+	if host != endpoint.Host && !strings.HasSuffix(host, "."+endpoint.Host) {
+		return
+	}
+	if f.current.CompareAndSwap(current, current+1) {
+		fmt.Fprintf(DebugLog, "Unable to connect to %s, failing over to %s\n", endpoint.Host, f.endpoint())
+	}
+}
+
+// isConnectionError reports whether err means the endpoint couldn't be
+// reached at all, as opposed to an error response.
+func isConnectionError(err error) bool {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	return errors.As(err, &dnsErr) || (errors.As(err, &opErr) && opErr.Op == "dial")
+}
+
+// withEndpointFailover adds a middleware reporting the connection failures
+// of requests to the failover, once their endpoint is resolved.
+func withEndpointFailover(failover *endpointFailover) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("EndpointFailover", func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+			out, metadata, err := next.HandleFinalize(ctx, in)
+			if req, ok := in.Request.(*smithyhttp.Request); ok && err != nil && isConnectionError(err) {
+				failover.fail(req.URL.Host)
+			}
+			return out, metadata, err
+		}), middleware.After)
+	}
+}
+
+// failoverResolver resolves every request against the current endpoint.
+type failoverResolver struct {
+	next     s3.EndpointResolverV2
+	failover *endpointFailover
+}
+
+func (r *failoverResolver) ResolveEndpoint(ctx context.Context, params s3.EndpointParameters) (smithyendpoints.Endpoint, error) {
+	params.Endpoint = aws.String(r.failover.endpoint())
+	return r.next.ResolveEndpoint(ctx, params)
+}
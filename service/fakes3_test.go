@@ -0,0 +1,293 @@
+package service
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 serves the objects of a single path-style bucket from memory, with
+// just enough of the S3 API for PutObject, GetObject, HeadObject,
+// ListObjectsV2 and multipart uploads.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+	gets    int
+	puts    int
+	lists   int
+
+	uploads    map[string]map[int][]byte // Parts by upload id
+	nextUpload int
+
+	// rejectChecksums fails the requests carrying checksums, as some
+	// S3-compatible stores do, and rejected counts them.
+	rejectChecksums bool
+	rejected        int
+
+	// putDelay is how long each PutObject takes, to count how many of them
+	// are in flight at once.
+	putDelay    time.Duration
+	inflight    int
+	maxInflight int
+}
+
+type fakeObject struct {
+	data   []byte
+	header http.Header
+}
+
+// startFakeS3 starts a fake S3 endpoint for bucket and points a fresh
+// client at it for the duration of the test.
+func startFakeS3(t *testing.T, bucket string) *fakeS3 {
+	t.Helper()
+	fake := &fakeS3{objects: map[string]*fakeObject{}}
+	server := httptest.NewServer(http.StripPrefix("/"+bucket, fake))
+	t.Cleanup(server.Close)
+
+	unsetenv(t, "AWS_CA_BUNDLE", "AWS_S3_ENDPOINTS", "AWS_PROFILE", "S3_PREFIX",
+		"S3_KEY_SUFFIX", "LFS_S3_OBJECTS_ROOT")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_S3_ENDPOINT", server.URL)
+	t.Setenv("AWS_REQUEST_CHECKSUM_CALCULATION", "when_required")
+	t.Setenv("AWS_RESPONSE_CHECKSUM_VALIDATION", "when_required")
+	t.Setenv("S3_USEPATHSTYLE", "true")
+	t.Setenv("S3_BUCKET", bucket)
+
+	resetS3Client := func() {
+		s3ClientMu.Lock()
+		s3Client = nil
+		s3ClientMu.Unlock()
+	}
+	resetS3Client()
+	t.Cleanup(resetS3Client)
+	return fake
+}
+
+// put stores an object directly, as another client would.
+func (f *fakeS3) put(key string, data []byte, header http.Header) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if header == nil {
+		header = http.Header{}
+	}
+	if header.Get("ETag") == "" {
+		header.Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(data)))
+	}
+	f.objects[key] = &fakeObject{data: data, header: header}
+}
+
+// keys returns the keys of the stored objects, sorted.
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	if key == "" && r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2" {
+		f.mu.Lock()
+		f.lists++
+		f.mu.Unlock()
+		f.list(w, r.URL.Query().Get("prefix"))
+		return
+	}
+
+	var data []byte
+	if r.Method == http.MethodPut {
+		f.mu.Lock()
+		f.inflight++
+		f.maxInflight = max(f.maxInflight, f.inflight)
+		f.mu.Unlock()
+		var err error
+		data, err = io.ReadAll(r.Body)
+		time.Sleep(f.putDelay)
+		f.mu.Lock()
+		f.inflight--
+		f.mu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rejectChecksums && sendsChecksum(r) {
+		f.rejected++
+		writeFakeError(w, http.StatusBadRequest, "InvalidRequest", "checksums are not supported")
+		return
+	}
+	if r.URL.Query().Has("uploads") || r.URL.Query().Has("uploadId") {
+		f.multipart(w, r, key, data)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		if r.Header.Get("If-None-Match") == "*" && f.objects[key] != nil {
+			writeFakeError(w, http.StatusPreconditionFailed, "PreconditionFailed", "the object exists")
+			return
+		}
+		f.puts++
+		header := http.Header{}
+		for name, values := range r.Header {
+			if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") || strings.HasPrefix(strings.ToLower(name), "x-amz-checksum-") {
+				header[name] = values
+			}
+		}
+		header.Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(data)))
+		f.objects[key] = &fakeObject{data: data, header: header}
+		w.Header().Set("ETag", header.Get("ETag"))
+	case http.MethodGet, http.MethodHead:
+		object := f.objects[key]
+		if object == nil {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			writeFakeError(w, http.StatusNotFound, "NoSuchKey", "no such key")
+			return
+		}
+		if r.Method == http.MethodGet {
+			f.gets++
+		}
+		for name, values := range object.header {
+			w.Header()[name] = values
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(object.data))
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported", http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	type content struct {
+		Key  string
+		Size int64
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Contents    []content
+		IsTruncated bool
+	}{}
+	for _, key := range f.keys() {
+		if strings.HasPrefix(key, prefix) {
+			f.mu.Lock()
+			size := int64(len(f.objects[key].data))
+			f.mu.Unlock()
+			result.Contents = append(result.Contents, content{Key: key, Size: size})
+		}
+	}
+	writeFakeXML(w, &result)
+}
+
+// multipart serves the requests of multipart uploads. ListParts and
+// CompleteMultipartUpload take all the parts uploaded so far.
+func (f *fakeS3) multipart(w http.ResponseWriter, r *http.Request, key string, data []byte) {
+	query := r.URL.Query()
+	if r.Method == http.MethodPost && query.Has("uploads") {
+		f.nextUpload++
+		id := fmt.Sprintf("upload%d", f.nextUpload)
+		if f.uploads == nil {
+			f.uploads = map[string]map[int][]byte{}
+		}
+		f.uploads[id] = map[int][]byte{}
+		writeFakeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Key      string
+			UploadId string
+		}{Key: key, UploadId: id})
+		return
+	}
+	id := query.Get("uploadId")
+	parts, ok := f.uploads[id]
+	if !ok {
+		writeFakeError(w, http.StatusNotFound, "NoSuchUpload", "no such upload")
+		return
+	}
+	numbers := make([]int, 0, len(parts))
+	for number := range parts {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+
+	switch r.Method {
+	case http.MethodPut:
+		var number int
+		fmt.Sscan(query.Get("partNumber"), &number)
+		parts[number] = data
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(data)))
+	case http.MethodGet:
+		type part struct {
+			PartNumber int
+			ETag       string
+			Size       int
+		}
+		result := struct {
+			XMLName     xml.Name `xml:"ListPartsResult"`
+			IsTruncated bool
+			Part        []part
+		}{}
+		for _, number := range numbers {
+			result.Part = append(result.Part, part{number, fmt.Sprintf(`"%x"`, md5.Sum(parts[number])), len(parts[number])})
+		}
+		writeFakeXML(w, result)
+	case http.MethodPost:
+		var object []byte
+		for _, number := range numbers {
+			object = append(object, parts[number]...)
+		}
+		delete(f.uploads, id)
+		etag := fmt.Sprintf(`"%x-%d"`, md5.Sum(object), len(numbers))
+		f.objects[key] = &fakeObject{data: object, header: http.Header{"Etag": {etag}}}
+		writeFakeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Key     string
+			ETag    string
+		}{Key: key, ETag: etag})
+	case http.MethodDelete:
+		delete(f.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// sendsChecksum reports whether r carries a checksum or asks for one.
+func sendsChecksum(r *http.Request) bool {
+	for name := range r.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-checksum-") || name == "x-amz-sdk-checksum-algorithm" || name == "x-amz-trailer" {
+			return true
+		}
+	}
+	return false
+}
+
+func writeFakeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+func writeFakeError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, message)
+}
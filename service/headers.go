@@ -0,0 +1,80 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// reservedHeaders are managed by the SDK and cannot be set in
+// S3_EXTRA_HEADERS.
+var reservedHeaders = map[string]bool{
+	"Authorization":  true,
+	"Content-Length": true,
+	"Host":           true,
+}
+
+// extraHeaders parses S3_EXTRA_HEADERS, a comma separated list of
+// Name=value pairs sent with every request.
+func extraHeaders() (http.Header, error) {
+	value := os.Getenv("S3_EXTRA_HEADERS")
+	if value == "" {
+		return nil, nil
+	}
+	headers := http.Header{}
+	for _, pair := range strings.Split(value, ",") {
+		name, headerValue, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		name = strings.TrimSpace(name)
+		if !ok || !validHeaderName(name) {
+			return nil, fmt.Errorf("invalid header %q in S3_EXTRA_HEADERS, expected Name=value", pair)
+		}
+		name = http.CanonicalHeaderKey(name)
+		if reservedHeaders[name] || strings.HasPrefix(name, "X-Amz-") {
+			return nil, fmt.Errorf("header %s in S3_EXTRA_HEADERS is managed by the SDK", name)
+		}
+		if strings.ContainsAny(headerValue, "\r\n") {
+			return nil, fmt.Errorf("invalid value of header %s in S3_EXTRA_HEADERS", name)
+		}
+		headers.Add(name, strings.TrimSpace(headerValue))
+	}
+	return headers, nil
+}
+
+// validHeaderName reports whether name is an HTTP token.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// withExtraHeaders adds a middleware setting headers on every request once
+// it is signed, so that gateways may strip them before the request reaches
+// S3. Headers the SDK already set are left alone.
+func withExtraHeaders(headers http.Header) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("ExtraHeaders", func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+			if req, ok := in.Request.(*smithyhttp.Request); ok {
+				for name, values := range headers {
+					if req.Header.Get(name) == "" {
+						req.Header[name] = values
+					}
+				}
+			}
+			return next.HandleFinalize(ctx, in)
+		}), middleware.After)
+	}
+}
@@ -0,0 +1,41 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/smithy-go/middleware"
+	"golang.org/x/sync/semaphore"
+)
+
+// headConcurrency returns S3_HEAD_CONCURRENCY, the maximum number of
+// HeadObject calls in flight at once, or 0 when unlimited.
+func headConcurrency() (int64, error) {
+	limit, err := envInt64("S3_HEAD_CONCURRENCY", 0)
+	if err != nil {
+		return 0, err
+	}
+	if limit < 0 {
+		return 0, fmt.Errorf("S3_HEAD_CONCURRENCY must not be negative")
+	}
+	return limit, nil
+}
+
+// withHeadLimit adds a middleware holding one of limit slots for each
+// HeadObject call, retries included, so that existence and checksum checks
+// can't starve transfers of requests.
+func withHeadLimit(limit int64) func(*middleware.Stack) error {
+	sem := semaphore.NewWeighted(limit)
+	return func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("HeadConcurrency", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			if middleware.GetOperationName(ctx) != "HeadObject" {
+				return next.HandleInitialize(ctx, in)
+			}
+			if err := sem.Acquire(ctx, 1); err != nil {
+				return middleware.InitializeOutput{}, middleware.Metadata{}, err
+			}
+			defer sem.Release(1)
+			return next.HandleInitialize(ctx, in)
+		}), middleware.After)
+	}
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxKeyLength is the longest key S3 accepts, in bytes of UTF-8.
+const maxKeyLength = 1024
+
+// keySuffix returns S3_KEY_SUFFIX, appended to the oid in every key, such as
+// an extension for tools browsing the bucket.
+func keySuffix() (string, error) {
+	suffix := os.Getenv("S3_KEY_SUFFIX")
+	if strings.Contains(suffix, "/") {
+		return "", fmt.Errorf("S3_KEY_SUFFIX must not contain a slash")
+	}
+	return suffix, nil
+}
+
+// sanitizeKeyPrefix applies the S3_KEY_SANITIZE options, separated by
+// commas, to a key prefix: "lower" lowercases it for case-insensitive
+// stores, "safe" replaces the characters outside of the ones AWS lists as
+// safe with "-", and "escape" percent-encodes them instead.
+func sanitizeKeyPrefix(prefix string) (string, error) {
+	for _, option := range strings.Split(os.Getenv("S3_KEY_SANITIZE"), ",") {
+		switch strings.TrimSpace(option) {
+		case "":
+		case "lower":
+			prefix = strings.ToLower(prefix)
+		case "safe":
+			prefix = strings.Map(func(r rune) rune {
+				if isSafeKeyRune(r) {
+					return r
+				}
+				return '-'
+			}, prefix)
+		case "escape":
+			var escaped strings.Builder
+			for _, r := range prefix {
+				if isSafeKeyRune(r) {
+					escaped.WriteRune(r)
+				} else {
+					escaped.WriteString(url.PathEscape(string(r)))
+				}
+			}
+			prefix = escaped.String()
+		default:
+			return "", fmt.Errorf("unknown option %s in S3_KEY_SANITIZE, expected lower, safe or escape", option)
+		}
+	}
+	return prefix, nil
+}
+
+// isSafeKeyRune reports whether r is one of the characters AWS deems safe in
+// keys, plus the slash used to delimit prefixes.
+func isSafeKeyRune(r rune) bool {
+	return r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("!-_.*'()/", r))
+}
+
+// validateKey checks key against the constraints of S3, so that an invalid
+// prefix fails before anything is transferred.
+func validateKey(key string) error {
+	if !utf8.ValidString(key) {
+		return fmt.Errorf("key %q is not valid UTF-8", key)
+	}
+	if len(key) > maxKeyLength {
+		return fmt.Errorf("key %q is longer than %d bytes", key, maxKeyLength)
+	}
+	for _, r := range key {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("key %q contains the control character %U", key, r)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// kmsKeyMapping assigns a KMS key to the objects whose key starts with
+// prefix.
+type kmsKeyMapping struct {
+	prefix string
+	keyID  string
+}
+
+var (
+	kmsKeyMap     []kmsKeyMapping
+	kmsKeyMapErr  error
+	kmsKeyMapOnce sync.Once
+)
+
+// loadKMSKeyMap reads S3_SSE_KMS_KEY_MAP, a file of "<key prefix> <key id>"
+// lines giving the KMS key of each namespace of a shared bucket. Empty
+// lines and lines starting with # are ignored.
+func loadKMSKeyMap() ([]kmsKeyMapping, error) {
+	kmsKeyMapOnce.Do(func() {
+		path := os.Getenv("S3_SSE_KMS_KEY_MAP")
+		if path == "" {
+			return
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			kmsKeyMapErr = fmt.Errorf("S3_SSE_KMS_KEY_MAP: %w", err)
+			return
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" || strings.HasPrefix(text, "#") {
+				continue
+			}
+			fields := strings.Fields(text)
+			if len(fields) != 2 {
+				kmsKeyMapErr = fmt.Errorf("S3_SSE_KMS_KEY_MAP line %d: expected a key prefix and a KMS key id", line)
+				return
+			}
+			kmsKeyMap = append(kmsKeyMap, kmsKeyMapping{prefix: strings.TrimPrefix(fields[0], "/"), keyID: fields[1]})
+		}
+		if err := scanner.Err(); err != nil {
+			kmsKeyMapErr = fmt.Errorf("S3_SSE_KMS_KEY_MAP: %w", err)
+		}
+	})
+	return kmsKeyMap, kmsKeyMapErr
+}
+
+// kmsKeyID returns the KMS key to encrypt key with: the one of the longest
+// matching prefix of S3_SSE_KMS_KEY_MAP, else S3_SSE_KMS_KEY_ID, else none.
+func kmsKeyID(key string) (string, error) {
+	mappings, err := loadKMSKeyMap()
+	if err != nil {
+		return "", err
+	}
+	keyID, matched := os.Getenv("S3_SSE_KMS_KEY_ID"), -1
+	for _, mapping := range mappings {
+		if strings.HasPrefix(key, mapping.prefix) && len(mapping.prefix) > matched {
+			keyID, matched = mapping.keyID, len(mapping.prefix)
+		}
+	}
+	return keyID, nil
+}
+
+// setKMSKey has the upload encrypted with the KMS key of its namespace.
+func setKMSKey(input *s3.PutObjectInput) error {
+	keyID, err := kmsKeyID(aws.ToString(input.Key))
+	if err != nil || keyID == "" {
+		return err
+	}
+	input.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+	input.SSEKMSKeyId = aws.String(keyID)
+	return nil
+}
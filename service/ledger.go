@@ -0,0 +1,61 @@
+package service
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// ledgerSchema keeps one row per completed transfer.
+const ledgerSchema = `
+CREATE TABLE IF NOT EXISTS transfers (
+	id           INTEGER PRIMARY KEY AUTOINCREMENT,
+	oid          TEXT    NOT NULL,
+	size         INTEGER NOT NULL,
+	direction    TEXT    NOT NULL,
+	completed_at TEXT    NOT NULL
+);
+CREATE INDEX IF NOT EXISTS transfers_oid ON transfers (oid);
+`
+
+var (
+	ledgerDB   *sql.DB
+	ledgerErr  error
+	ledgerOnce sync.Once
+)
+
+// getLedger opens the SQLite ledger set in LFS_S3_STATE_DB, or returns nil
+// when none is configured.
+func getLedger() (*sql.DB, error) {
+	path := os.Getenv("LFS_S3_STATE_DB")
+	if path == "" {
+		return nil, nil
+	}
+	ledgerOnce.Do(func() {
+		// Several agents may write at once, wait for each other's locks.
+		db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)")
+		if err == nil {
+			_, err = db.Exec(ledgerSchema)
+		}
+		ledgerDB, ledgerErr = db, err
+	})
+	return ledgerDB, ledgerErr
+}
+
+// recordTransfer adds a completed transfer to the ledger. Failures are only
+// logged, the transfer itself already succeeded.
+func recordTransfer(oid string, size int64, direction string, stderr io.Writer) {
+	db, err := getLedger()
+	if err == nil && db != nil {
+		_, err = db.Exec("INSERT INTO transfers (oid, size, direction, completed_at) VALUES (?, ?, ?, ?)",
+			oid, size, direction, time.Now().UTC().Format(time.RFC3339))
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Unable to record transfer of %s in ledger: %v\n", oid, err)
+	}
+}
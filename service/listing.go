@@ -0,0 +1,36 @@
+package service
+
+import (
+	"fmt"
+)
+
+// maxListPageSize is the most keys, uploads or parts S3 returns per page.
+const maxListPageSize = 1000
+
+// listPageSize returns S3_LIST_PAGE_SIZE, the number of entries requested
+// per listing page, or nil to keep the server default.
+func listPageSize() (*int32, error) {
+	size, err := envInt64("S3_LIST_PAGE_SIZE", 0)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 || size > maxListPageSize {
+		return nil, fmt.Errorf("S3_LIST_PAGE_SIZE must be between 1 and %d", maxListPageSize)
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	pageSize := int32(size)
+	return &pageSize, nil
+}
+
+// listShards splits the keys under prefix by the first hex digit of their
+// oid, so that they can be listed concurrently.
+func listShards(prefix string) []string {
+	const digits = "0123456789abcdef"
+	shards := make([]string, 0, len(digits))
+	for _, digit := range digits {
+		shards = append(shards, prefix+string(digit))
+	}
+	return shards
+}
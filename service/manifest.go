@@ -0,0 +1,104 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Whether LFS_S3_MANIFEST is added to or started afresh by each process,
+// set by LFS_S3_MANIFEST_MODE.
+const (
+	manifestAppend    = "append"
+	manifestOverwrite = "overwrite"
+)
+
+// manifestEntry is written to LFS_S3_MANIFEST for every uploaded object.
+type manifestEntry struct {
+	Oid          string `json:"oid"`
+	Key          string `json:"key"`
+	Size         int64  `json:"size"`
+	StorageClass string `json:"storage_class"`
+}
+
+var (
+	manifestMu   sync.Mutex
+	manifestFile *os.File
+	manifestErr  error
+	manifestOnce sync.Once
+)
+
+// getManifestMode returns the mode set in LFS_S3_MANIFEST_MODE.
+func getManifestMode() (string, error) {
+	switch mode := os.Getenv("LFS_S3_MANIFEST_MODE"); mode {
+	case "":
+		return manifestAppend, nil
+	case manifestAppend, manifestOverwrite:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown mode %s in LFS_S3_MANIFEST_MODE, expected append or overwrite", mode)
+	}
+}
+
+// openManifest opens LFS_S3_MANIFEST once per process.
+func openManifest() (*os.File, error) {
+	manifestOnce.Do(func() {
+		mode, err := getManifestMode()
+		if err != nil {
+			manifestErr = err
+			return
+		}
+		flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		if mode == manifestOverwrite {
+			flags |= os.O_TRUNC
+		}
+		manifestFile, manifestErr = os.OpenFile(os.Getenv("LFS_S3_MANIFEST"), flags, 0666)
+	})
+	return manifestFile, manifestErr
+}
+
+// writeManifestEntry records an uploaded object in LFS_S3_MANIFEST, if set,
+// as a JSON line. Failing to do so doesn't fail the upload.
+func writeManifestEntry(ctx context.Context, oid string, size int64, stderr io.Writer) {
+	if os.Getenv("LFS_S3_MANIFEST") == "" {
+		return
+	}
+	err := func() error {
+		client, err := getS3Client()
+		if err != nil {
+			return err
+		}
+		key, err := locateKey(ctx, client, oid)
+		if err != nil {
+			return err
+		}
+		class, err := getStorageClass()
+		if err != nil {
+			return err
+		}
+		if class == "" {
+			class = types.StorageClassStandard
+		}
+		line, err := json.Marshal(&manifestEntry{Oid: oid, Key: key, Size: size, StorageClass: string(class)})
+		if err != nil {
+			return err
+		}
+
+		file, err := openManifest()
+		if err != nil {
+			return err
+		}
+		manifestMu.Lock()
+		defer manifestMu.Unlock()
+		_, err = file.Write(append(line, '\n'))
+		return err
+	}()
+	if err != nil {
+		fmt.Fprintf(stderr, "Unable to write %s to the manifest: %v\n", oid, err)
+	}
+}
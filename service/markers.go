@@ -0,0 +1,22 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// markTransfer logs a transfer.start marker for log scrapers, and returns
+// a function logging the matching transfer.end marker.
+func markTransfer(oid string, direction string, size int64, stderr io.Writer) func(err error) {
+	start := time.Now()
+	fmt.Fprintf(stderr, "transfer.start oid=%s direction=%s size=%d\n", oid, direction, size)
+	return func(err error) {
+		status := "ok"
+		if err != nil {
+			status = "error"
+		}
+		fmt.Fprintf(stderr, "transfer.end oid=%s direction=%s size=%d status=%s duration_ms=%d\n",
+			oid, direction, size, status, time.Since(start).Milliseconds())
+	}
+}
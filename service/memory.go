@@ -0,0 +1,43 @@
+package service
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+)
+
+var (
+	memorySem   *semaphore.Weighted
+	memoryLimit int64
+	memoryErr   error
+	memoryOnce  sync.Once
+)
+
+// reserveMemory blocks until n more bytes of transfer buffers fit under
+// S3_MAX_MEMORY, and returns a function releasing them. Without a limit it
+// returns immediately. The limit applies to this process, and Git LFS runs
+// one process per concurrent transfer.
+func reserveMemory(ctx context.Context, n int64) (func(), error) {
+	memoryOnce.Do(func() {
+		memoryLimit, memoryErr = envInt64("S3_MAX_MEMORY", 0)
+		if memoryErr == nil && memoryLimit > 0 {
+			memorySem = semaphore.NewWeighted(memoryLimit)
+		}
+	})
+	if memoryErr != nil {
+		return nil, memoryErr
+	}
+	if memorySem == nil || n <= 0 {
+		return func() {}, nil
+	}
+
+	// A transfer needing more than the whole limit runs alone.
+	if n > memoryLimit {
+		n = memoryLimit
+	}
+	if err := memorySem.Acquire(ctx, n); err != nil {
+		return nil, err
+	}
+	return func() { memorySem.Release(n) }, nil
+}
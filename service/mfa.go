@@ -0,0 +1,76 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+)
+
+// mfaCacheMargin is how long before their expiry cached session credentials
+// are no longer used.
+const mfaCacheMargin = 5 * time.Minute
+
+// mfaOptions has the assume role flow of AWS_PROFILE use the MFA code in
+// AWS_MFA_TOKEN, for profiles with an mfa_serial. git-lfs owns stdin, so
+// the code can't be prompted for.
+func mfaOptions() []func(*config.LoadOptions) error {
+	token := os.Getenv("AWS_MFA_TOKEN")
+	if token == "" {
+		return nil
+	}
+	return []func(*config.LoadOptions) error{
+		config.WithAssumeRoleCredentialOptions(func(o *stscreds.AssumeRoleOptions) {
+			o.TokenProvider = func() (string, error) {
+				return token, nil
+			}
+		}),
+	}
+}
+
+// mfaCachePath returns where the session credentials obtained with the MFA
+// code of the profile are cached. git-lfs starts several processes, and an
+// MFA code can only be used once.
+func mfaCachePath() string {
+	sum := sha256.Sum256([]byte(os.Getenv("AWS_PROFILE") + "\x00" + os.Getenv("AWS_MFA_TOKEN")))
+	return filepath.Join(os.TempDir(), "lfs-s3-mfa-"+hex.EncodeToString(sum[:8])+".json")
+}
+
+// mfaCacheProvider shares the session credentials of an MFA code between the
+// processes of a git-lfs run through a file only readable by the user.
+type mfaCacheProvider struct {
+	next aws.CredentialsProvider
+	path string
+}
+
+func (p *mfaCacheProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	var creds aws.Credentials
+	data, err := os.ReadFile(p.path)
+	if err == nil && json.Unmarshal(data, &creds) == nil && creds.CanExpire && time.Until(creds.Expires) > mfaCacheMargin {
+		return creds, nil
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return aws.Credentials{}, err
+	}
+
+	creds, err = p.next.Retrieve(ctx)
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	if data, err := json.Marshal(&creds); err == nil {
+		tmpPath := p.path + ".tmp"
+		if os.WriteFile(tmpPath, data, 0600) == nil {
+			os.Rename(tmpPath, p.path)
+		}
+	}
+	return creds, nil
+}
@@ -0,0 +1,43 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// uploadToMirror copies an uploaded object to S3_MIRROR_BUCKET, if set. A
+// failure is only logged, unless S3_MIRROR_REQUIRED is set.
+func uploadToMirror(ctx context.Context, oid string, size int64, localPath string, stderr io.Writer) error {
+	mirror := os.Getenv("S3_MIRROR_BUCKET")
+	if mirror == "" {
+		return nil
+	}
+	// Progress was already reported for the upload to the main bucket.
+	err := uploadObjectTo(ctx, mirror, oid, size, localPath, io.Discard, stderr)
+	if err == nil {
+		return nil
+	}
+	if envBool("S3_MIRROR_REQUIRED") {
+		return fmt.Errorf("mirroring to %s: %w", mirror, err)
+	}
+	fmt.Fprintf(stderr, "Unable to mirror %s to %s: %s\n", oid, mirror, describeError(err))
+	return nil
+}
+
+// downloadFromMirror retries a failed download from S3_MIRROR_BUCKET, if
+// set, returning the original error if the mirror can't help. The progress
+// resumes from what the failed download reported.
+func downloadFromMirror(ctx context.Context, oid string, size int64, localPath string, progress *progressTracker, stderr io.Writer, err error) error {
+	mirror := os.Getenv("S3_MIRROR_BUCKET")
+	if mirror == "" || errors.Is(err, context.Canceled) {
+		return err
+	}
+	fmt.Fprintf(stderr, "Downloading %s from mirror %s after: %s\n", oid, mirror, describeError(err))
+	if mirrorErr := downloadObjectFrom(ctx, mirror, oid, size, localPath, progress, stderr); mirrorErr != nil {
+		return fmt.Errorf("%w (mirror %s: %v)", err, mirror, mirrorErr)
+	}
+	return nil
+}
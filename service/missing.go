@@ -0,0 +1,56 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Behaviors on downloads of missing objects, selected by
+// S3_MISSING_OBJECT_BEHAVIOR.
+const (
+	missingObjectError = "error"
+	missingObjectEmpty = "empty"
+)
+
+// missingObjectBehavior returns the behavior set in S3_MISSING_OBJECT_BEHAVIOR.
+func missingObjectBehavior() (string, error) {
+	switch behavior := os.Getenv("S3_MISSING_OBJECT_BEHAVIOR"); behavior {
+	case "":
+		return missingObjectError, nil
+	case missingObjectError, missingObjectEmpty:
+		return behavior, nil
+	default:
+		return "", fmt.Errorf("unknown behavior %s in S3_MISSING_OBJECT_BEHAVIOR, expected error or empty", behavior)
+	}
+}
+
+// emptyIfMissing handles a download that failed because the object is not
+// in the bucket. With S3_MISSING_OBJECT_BEHAVIOR=empty it writes an empty
+// file to localPath instead, which is not checked against the OID. Other
+// errors are returned as they are.
+func emptyIfMissing(oid string, localPath string, stderr io.Writer, err error) error {
+	if !isNotFound(err) {
+		return err
+	}
+	if behavior, _ := missingObjectBehavior(); behavior != missingObjectEmpty {
+		return err
+	}
+	fileMode, modeErr := envFileMode("S3_OBJECT_FILE_MODE", defaultObjectFileMode)
+	if modeErr != nil {
+		return modeErr
+	}
+	dirMode, modeErr := envFileMode("S3_OBJECT_DIR_MODE", defaultObjectDirMode)
+	if modeErr != nil {
+		return modeErr
+	}
+	if err := os.MkdirAll(filepath.Dir(localPath), dirMode); err != nil {
+		return fmt.Errorf("creating directory: %w", err)
+	}
+	if err := os.WriteFile(localPath, nil, fileMode); err != nil {
+		return fmt.Errorf("creating file: %w", err)
+	}
+	fmt.Fprintf(stderr, "Object %s is missing from the bucket, wrote an empty file instead\n", oid)
+	return nil
+}
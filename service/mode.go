@@ -0,0 +1,78 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"git.sr.ht/~ngraves/lfs-s3/api"
+)
+
+// Protocol variants selected by LFS_S3_MODE. Git LFS talks to standalone
+// agents without asking the LFS API first, so transfer requests carry no
+// action. Otherwise each request carries the action returned by the batch
+// API, and only objects the API asked for are ever sent.
+const (
+	modeAuto       = ""
+	modeStandalone = "standalone"
+	modeCustom     = "custom"
+)
+
+// Access modes selected by LFS_S3_MODE, limiting which transfers are served.
+const (
+	accessReadWrite = "readwrite"
+	accessReadOnly  = "readonly"
+	accessWriteOnly = "writeonly"
+)
+
+// getModes returns the protocol variant and the access mode set in
+// LFS_S3_MODE, a comma-separated list holding at most one of each.
+func getModes() (string, string, error) {
+	protocol, access := modeAuto, accessReadWrite
+	var seenProtocol, seenAccess bool
+	for _, mode := range strings.Split(os.Getenv("LFS_S3_MODE"), ",") {
+		switch mode = strings.TrimSpace(mode); mode {
+		case "":
+		case modeStandalone, modeCustom:
+			if seenProtocol {
+				return "", "", fmt.Errorf("LFS_S3_MODE sets both %s and %s", protocol, mode)
+			}
+			protocol, seenProtocol = mode, true
+		case accessReadWrite, accessReadOnly, accessWriteOnly:
+			if seenAccess {
+				return "", "", fmt.Errorf("LFS_S3_MODE sets both %s and %s", access, mode)
+			}
+			access, seenAccess = mode, true
+		default:
+			return "", "", fmt.Errorf("unknown mode %s in LFS_S3_MODE, expected standalone, custom, readonly, readwrite or writeonly", mode)
+		}
+	}
+	return protocol, access, nil
+}
+
+// checkEvent rejects the transfer events the access mode does not allow.
+func checkEvent(access string, event string) error {
+	switch {
+	case access == accessReadOnly && event == "upload":
+		return fmt.Errorf("uploads are disabled, LFS_S3_MODE is %s", access)
+	case access == accessWriteOnly && event == "download":
+		return fmt.Errorf("downloads are disabled, LFS_S3_MODE is %s", access)
+	}
+	return nil
+}
+
+// checkAction validates a transfer request against the protocol variant.
+func checkAction(mode string, req *api.Request, stderr io.Writer) error {
+	switch mode {
+	case modeStandalone:
+		if req.Action != nil {
+			fmt.Fprintf(stderr, "Ignoring LFS API action for %s in standalone mode\n", req.Oid)
+		}
+	case modeCustom:
+		if req.Action == nil {
+			return fmt.Errorf("no LFS API action given for %s, configure lfs-s3 as a standalone agent or set LFS_S3_MODE=standalone", req.Oid)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// lockObject takes an exclusive lock on the download of oid across
+// processes, if LFS_S3_LOCK_DOWNLOADS is set, for parallel jobs sharing an
+// objects directory. The lock file is kept next to the staged downloads.
+func lockObject(oid string, localPath string) (func(), error) {
+	if !envBool("LFS_S3_LOCK_DOWNLOADS") {
+		return func() {}, nil
+	}
+	lockPath := filepath.Join(stageDir(localPath), oid+".lock")
+	if err := os.MkdirAll(filepath.Dir(lockPath), 0777); err != nil {
+		return nil, fmt.Errorf("creating lock directory: %w", err)
+	}
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("opening lock file: %w", err)
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("locking %s: %w", lockPath, err)
+	}
+	// Closing the file releases the lock.
+	return func() { file.Close() }, nil
+}
+
+// downloadedMeanwhile reports whether another process already put an
+// object of the expected size at localPath while waiting for the lock.
+func downloadedMeanwhile(localPath string, size int64) bool {
+	info, err := os.Stat(localPath)
+	return err == nil && info.Mode().IsRegular() && info.Size() == size
+}
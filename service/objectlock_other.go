@@ -0,0 +1,12 @@
+//go:build !unix && !windows
+
+package service
+
+import (
+	"errors"
+	"os"
+)
+
+func lockFile(file *os.File) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,41 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// expectedBucketOwner returns the account ID set in S3_EXPECTED_BUCKET_OWNER.
+func expectedBucketOwner() (string, error) {
+	owner := os.Getenv("S3_EXPECTED_BUCKET_OWNER")
+	if owner == "" {
+		return "", nil
+	}
+	if len(owner) != 12 {
+		return "", fmt.Errorf("invalid account ID %s in S3_EXPECTED_BUCKET_OWNER, expected 12 digits", owner)
+	}
+	for _, c := range owner {
+		if c < '0' || c > '9' {
+			return "", fmt.Errorf("invalid account ID %s in S3_EXPECTED_BUCKET_OWNER, expected 12 digits", owner)
+		}
+	}
+	return owner, nil
+}
+
+// withExpectedBucketOwner adds a middleware setting the ExpectedBucketOwner
+// of every operation, so that S3 refuses requests to a bucket of another
+// account. The header is set before signing, as the input field would be.
+func withExpectedBucketOwner(owner string) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		return stack.Build.Add(middleware.BuildMiddlewareFunc("ExpectedBucketOwner", func(ctx context.Context, in middleware.BuildInput, next middleware.BuildHandler) (middleware.BuildOutput, middleware.Metadata, error) {
+			if req, ok := in.Request.(*smithyhttp.Request); ok && req.Header.Get("X-Amz-Expected-Bucket-Owner") == "" {
+				req.Header.Set("X-Amz-Expected-Bucket-Owner", owner)
+			}
+			return next.HandleBuild(ctx, in)
+		}), middleware.After)
+	}
+}
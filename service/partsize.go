@@ -0,0 +1,49 @@
+package service
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+)
+
+const defaultPartSize = 5 * 1024 * 1024
+
+// partSize returns the part size set in the named variable, falling back to
+// the shared S3_PART_SIZE and then to the default.
+func partSize(name string) (int64, error) {
+	shared, err := envInt64("S3_PART_SIZE", defaultPartSize)
+	if err != nil {
+		return 0, err
+	}
+	size, err := envInt64(name, shared)
+	if err != nil {
+		return 0, err
+	}
+	if size < manager.MinUploadPartSize {
+		return 0, fmt.Errorf("part size %d is below the S3 minimum of %d bytes", size, manager.MinUploadPartSize)
+	}
+	return size, nil
+}
+
+// uploadPartSize returns the multipart size used by store.
+func uploadPartSize() (int64, error) {
+	return partSize("S3_UPLOAD_PART_SIZE")
+}
+
+// downloadPartSize returns the ranged GET size used by retrieve.
+func downloadPartSize() (int64, error) {
+	return partSize("S3_DOWNLOAD_PART_SIZE")
+}
+
+// fitPartSize raises the part size of an upload of size bytes when needed to
+// stay within the S3 limit of parts per upload, to a multiple of 5MiB.
+func fitPartSize(partSize int64, size int64, oid string, stderr io.Writer) int64 {
+	minSize := (size + int64(manager.MaxUploadParts) - 1) / int64(manager.MaxUploadParts)
+	minSize = (minSize + defaultPartSize - 1) / defaultPartSize * defaultPartSize
+	if minSize <= partSize {
+		return partSize
+	}
+	fmt.Fprintf(stderr, "Using parts of %d bytes for %s, as %d byte parts would exceed %d parts\n", minSize, oid, partSize, manager.MaxUploadParts)
+	return minSize
+}
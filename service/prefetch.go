@@ -0,0 +1,113 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const defaultPrefetchConcurrency = 8
+
+// prefetchItem is an object listed for prefetching.
+type prefetchItem struct {
+	oid  string
+	size int64
+}
+
+// readOidList parses one object per line, as printed by
+// `git lfs ls-files --long`, or as an oid optionally followed by its size.
+func readOidList(input io.Reader) ([]prefetchItem, error) {
+	var items []prefetchItem
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields[0]) != 64 {
+			return nil, fmt.Errorf("%q is not a full oid, use git lfs ls-files --long", fields[0])
+		}
+		item := prefetchItem{oid: fields[0]}
+		if len(fields) > 1 {
+			// Sizes are only known when given as plain byte counts.
+			if size, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				item.size = size
+			}
+		}
+		items = append(items, item)
+	}
+	return items, scanner.Err()
+}
+
+// Prefetch downloads the objects listed in input into the local LFS store
+// with LFS_S3_PREFETCH_CONCURRENCY workers, skipping those already there.
+// It prints the overall progress to stdout and returns false if any
+// download failed.
+func Prefetch(input io.Reader, stdout, stderr io.Writer) bool {
+	if err := checkConfig(); err != nil {
+		fmt.Fprintf(stdout, "Configuration error: %v\n", err)
+		return false
+	}
+	workers, err := envInt64("LFS_S3_PREFETCH_CONCURRENCY", defaultPrefetchConcurrency)
+	if err != nil || workers < 1 {
+		fmt.Fprintf(stdout, "Configuration error: invalid LFS_S3_PREFETCH_CONCURRENCY\n")
+		return false
+	}
+	items, err := readOidList(input)
+	if err != nil {
+		fmt.Fprintf(stdout, "Error reading the object list: %v\n", err)
+		return false
+	}
+
+	queue := make(chan prefetchItem)
+	var (
+		mu                    sync.Mutex
+		done, failed, skipped int
+		totalBytes            int64
+		wg                    sync.WaitGroup
+	)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range queue {
+				localPath := localObjectPath(item.oid)
+				_, statErr := os.Stat(localPath)
+				var err error
+				if statErr != nil {
+					_, err = fetchObject(item.oid, item.size, io.Discard, stderr)
+				}
+
+				mu.Lock()
+				done++
+				switch {
+				case err != nil:
+					failed++
+					fmt.Fprintf(stdout, "[%d/%d] Error downloading %s: %s\n", done, len(items), item.oid, describeError(err))
+				case statErr == nil:
+					skipped++
+					fmt.Fprintf(stdout, "[%d/%d] %s already present\n", done, len(items), item.oid)
+				default:
+					if info, err := os.Stat(localPath); err == nil {
+						totalBytes += info.Size()
+					}
+					fmt.Fprintf(stdout, "[%d/%d] Downloaded %s, %d bytes so far\n", done, len(items), item.oid, totalBytes)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, item := range items {
+		queue <- item
+	}
+	close(queue)
+	wg.Wait()
+
+	fmt.Fprintf(stdout, "Prefetched %d objects (%d bytes), %d already present, %d failed\n",
+		done-skipped-failed, totalBytes, skipped, failed)
+	return failed == 0
+}
@@ -0,0 +1,215 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"git.sr.ht/~ngraves/lfs-s3/api"
+)
+
+const (
+	defaultProgressInterval      = 100 * time.Millisecond
+	defaultProgressFlushInterval = 200 * time.Millisecond
+)
+
+// progressLogInterval throttles the progress logged to stderr, which is read
+// by people rather than by lfs.
+const progressLogInterval = time.Second
+
+// progressTracker reports the bytes read or written through it to lfs, at
+// most once per Interval and always once the whole object went through.
+// When flushing, the bytes are instead reported on a steady cadence by a
+// goroutine, until stop is called.
+type progressTracker struct {
+	Reader         io.Reader
+	Writer         io.WriterAt
+	Oid            string
+	TotalSize      int64
+	Interval       time.Duration
+	RespWriter     io.Writer
+	ErrWriter      io.Writer
+	mu             sync.Mutex
+	bytesProcessed int64
+	bytesSinceLast int
+	replayed       int64
+	lastSent       time.Time
+	lastLogged     time.Time
+	flushing       bool
+	flushErr       error
+	stopFlush      chan struct{}
+	flushDone      chan struct{}
+}
+
+// progressFlushInterval returns the cadence set in
+// S3_PROGRESS_FLUSH_INTERVAL. It defaults to none when S3_PROGRESS_INTERVAL
+// is set, so that its throttling keeps applying.
+func progressFlushInterval() (time.Duration, error) {
+	def := defaultProgressFlushInterval
+	if os.Getenv("S3_PROGRESS_INTERVAL") != "" {
+		def = 0
+	}
+	interval, err := envDuration("S3_PROGRESS_FLUSH_INTERVAL", def)
+	if err != nil {
+		return 0, err
+	}
+	if interval < 0 {
+		return 0, fmt.Errorf("S3_PROGRESS_FLUSH_INTERVAL must not be negative")
+	}
+	return interval, nil
+}
+
+// newProgressTracker creates a tracker using the S3_PROGRESS_INTERVAL
+// throttling, or flushing every S3_PROGRESS_FLUSH_INTERVAL. It must be
+// stopped before the transfer is reported complete.
+func newProgressTracker(oid string, size int64, writer io.Writer, stderr io.Writer) (*progressTracker, error) {
+	interval, err := envDuration("S3_PROGRESS_INTERVAL", defaultProgressInterval)
+	if err != nil {
+		return nil, err
+	}
+	flushInterval, err := progressFlushInterval()
+	if err != nil {
+		return nil, err
+	}
+	rw := &progressTracker{
+		Oid:        oid,
+		TotalSize:  size,
+		Interval:   interval,
+		RespWriter: writer,
+		ErrWriter:  stderr,
+	}
+	if flushInterval > 0 {
+		rw.flushing = true
+		rw.stopFlush = make(chan struct{})
+		rw.flushDone = make(chan struct{})
+		go rw.flush(flushInterval)
+	}
+	return rw, nil
+}
+
+// flush reports the bytes accumulated since the last report every interval.
+func (rw *progressTracker) flush(interval time.Duration) {
+	defer close(rw.flushDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rw.stopFlush:
+			return
+		case <-ticker.C:
+			rw.mu.Lock()
+			if rw.bytesSinceLast > 0 && rw.flushErr == nil {
+				rw.flushErr = rw.send()
+			}
+			rw.mu.Unlock()
+		}
+	}
+}
+
+// stop ends the flushing, reporting the bytes still pending, once no
+// progress event is being sent anymore.
+func (rw *progressTracker) stop() {
+	rw.mu.Lock()
+	flushing := rw.flushing
+	rw.flushing = false
+	rw.mu.Unlock()
+	if !flushing {
+		return
+	}
+	close(rw.stopFlush)
+	<-rw.flushDone
+
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.bytesSinceLast > 0 && rw.flushErr == nil {
+		if err := rw.send(); err != nil {
+			fmt.Fprintf(rw.ErrWriter, "%v\n", err)
+		}
+	}
+}
+
+func (rw *progressTracker) Read(p []byte) (n int, err error) {
+	n, err = rw.Reader.Read(p)
+	if n > 0 {
+		if sendErr := rw.report(n); sendErr != nil {
+			return n, sendErr
+		}
+	}
+	return
+}
+
+// WriteAt writes the remainder of short writes, which io.WriterAt doesn't
+// allow without an error but some writers return anyway, and reports only
+// the bytes actually written.
+func (rw *progressTracker) WriteAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) && err == nil {
+		var written int
+		written, err = rw.Writer.WriteAt(p[n:], off+int64(n))
+		n += written
+		if written > 0 {
+			if sendErr := rw.report(written); sendErr != nil {
+				return n, sendErr
+			}
+		} else if err == nil {
+			err = io.ErrShortWrite
+		}
+	}
+	return
+}
+
+// rewind is called when the transfer starts over, so that the bytes
+// already reported are not reported again.
+func (rw *progressTracker) rewind() {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.replayed = rw.bytesProcessed
+}
+
+// report accounts for n more bytes and sends a progress event if one is due.
+func (rw *progressTracker) report(n int) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if rw.replayed > 0 {
+		skipped := min(int64(n), rw.replayed)
+		rw.replayed -= skipped
+		n -= int(skipped)
+		if n == 0 {
+			return nil
+		}
+	}
+	rw.bytesProcessed += int64(n)
+	rw.bytesSinceLast += n
+	if rw.flushErr != nil {
+		return rw.flushErr
+	}
+	done := rw.TotalSize > 0 && rw.bytesProcessed >= rw.TotalSize
+	if !done && (rw.flushing || time.Since(rw.lastSent) < rw.Interval) {
+		return nil
+	}
+	return rw.send()
+}
+
+// send reports the bytes accumulated since the last report. The caller
+// holds the lock.
+func (rw *progressTracker) send() error {
+	err := api.SendProgress(rw.Oid, rw.bytesProcessed, rw.bytesSinceLast, rw.RespWriter, rw.ErrWriter)
+	if err != nil {
+		return fmt.Errorf("reporting progress: %w", err)
+	}
+	rw.bytesSinceLast = 0
+	rw.lastSent = time.Now()
+
+	done := rw.TotalSize > 0 && rw.bytesProcessed >= rw.TotalSize
+	if done || time.Since(rw.lastLogged) >= progressLogInterval {
+		if rw.TotalSize > 0 {
+			fmt.Fprintf(rw.ErrWriter, "Progress of %s: %d%% (%d of %d bytes)\n", rw.Oid, rw.bytesProcessed*100/rw.TotalSize, rw.bytesProcessed, rw.TotalSize)
+		} else {
+			fmt.Fprintf(rw.ErrWriter, "Progress of %s: %d bytes\n", rw.Oid, rw.bytesProcessed)
+		}
+		rw.lastLogged = rw.lastSent
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"git.sr.ht/~ngraves/lfs-s3/api"
+)
+
+// shortWriterAt writes at most max bytes per call, without an error.
+type shortWriterAt struct {
+	buf []byte
+	max int
+}
+
+func (w *shortWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	n := min(len(p), w.max)
+	copy(w.buf[off:], p[:n])
+	return n, nil
+}
+
+func TestProgressTrackerShortWrites(t *testing.T) {
+	t.Setenv("S3_PROGRESS_FLUSH_INTERVAL", "0")
+	t.Setenv("S3_PROGRESS_INTERVAL", "0")
+	data := []byte("0123456789abcdef")
+	var out bytes.Buffer
+	dst := &shortWriterAt{buf: make([]byte, len(data)), max: 3}
+	tracker, err := newProgressTracker("oid", int64(len(data)), &out, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.Writer = dst
+
+	n, err := tracker.WriteAt(data[4:], 4)
+	if err != nil || n != len(data)-4 {
+		t.Fatalf("WriteAt = %d, %v, want %d, nil", n, err, len(data)-4)
+	}
+	n, err = tracker.WriteAt(data[:4], 0)
+	if err != nil || n != 4 {
+		t.Fatalf("WriteAt = %d, %v, want 4, nil", n, err)
+	}
+	tracker.stop()
+	if !bytes.Equal(dst.buf, data) {
+		t.Errorf("wrote %q, want %q", dst.buf, data)
+	}
+
+	var last api.ProgressResponse
+	var total int
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		if err := json.Unmarshal(scanner.Bytes(), &last); err != nil {
+			t.Fatal(err)
+		}
+		if last.BytesSinceLast > 3 {
+			t.Errorf("reported %d bytes at once, more than a single write", last.BytesSinceLast)
+		}
+		total += last.BytesSinceLast
+	}
+	if last.BytesSoFar != int64(len(data)) || total != len(data) {
+		t.Errorf("reported %d bytes so far and %d in total, want %d", last.BytesSoFar, total, len(data))
+	}
+}
+
+// stuckWriterAt never writes anything.
+type stuckWriterAt struct{}
+
+func (stuckWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	return 0, nil
+}
+
+func TestProgressTrackerStuckWrite(t *testing.T) {
+	tracker, err := newProgressTracker("oid", 4, io.Discard, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.stop()
+	tracker.Writer = stuckWriterAt{}
+	if _, err := tracker.WriteAt([]byte("data"), 0); err != io.ErrShortWrite {
+		t.Errorf("WriteAt error = %v, want %v", err, io.ErrShortWrite)
+	}
+}
+
+func TestProgressTrackerRewind(t *testing.T) {
+	t.Setenv("S3_PROGRESS_FLUSH_INTERVAL", "0")
+	t.Setenv("S3_PROGRESS_INTERVAL", "0")
+	data := []byte("0123456789abcdef")
+	var out bytes.Buffer
+	tracker, err := newProgressTracker("oid", int64(len(data)), &out, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A failed attempt writes 8 bytes of the object, then another one
+	// starts over and writes all of it.
+	tracker.Writer = &shortWriterAt{buf: make([]byte, len(data)), max: len(data)}
+	for _, off := range []int{0, 6} {
+		if _, err := tracker.WriteAt(data[off:off+4], int64(off)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tracker.rewind()
+	for _, off := range []int{0, 8} {
+		if _, err := tracker.WriteAt(data[off:off+8], int64(off)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tracker.stop()
+
+	var event api.ProgressResponse
+	var soFar int64
+	var total int
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.BytesSoFar < soFar {
+			t.Errorf("progress went back from %d to %d bytes", soFar, event.BytesSoFar)
+		}
+		soFar = event.BytesSoFar
+		total += event.BytesSinceLast
+	}
+	if soFar != int64(len(data)) || total != len(data) {
+		t.Errorf("reported %d bytes so far and %d in total, want %d", soFar, total, len(data))
+	}
+}
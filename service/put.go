@@ -0,0 +1,58 @@
+package service
+
+import (
+	"context"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// progressSection reads a section of a file, reporting progress once for
+// each byte however often it is read again after seeking back, as the SDK
+// does to checksum bodies over plain HTTP.
+type progressSection struct {
+	*io.SectionReader
+	progress *progressTracker
+	pos      int64
+	reported int64
+}
+
+func (s *progressSection) Read(p []byte) (n int, err error) {
+	n, err = s.SectionReader.Read(p)
+	s.pos += int64(n)
+	if s.pos > s.reported {
+		if reportErr := s.progress.report(int(s.pos - s.reported)); reportErr != nil {
+			return n, reportErr
+		}
+		s.reported = s.pos
+	}
+	return
+}
+
+func (s *progressSection) Seek(offset int64, whence int) (int64, error) {
+	pos, err := s.SectionReader.Seek(offset, whence)
+	if err == nil {
+		s.pos = pos
+	}
+	return pos, err
+}
+
+// putObject uploads an object of known size in a single request, streaming
+// it from file rather than buffering it as the uploader does.
+func putObject(ctx context.Context, client *s3.Client, input *s3.PutObjectInput, file io.ReaderAt, size int64, progress *progressTracker) (*manager.UploadOutput, error) {
+	putInput := *input
+	putInput.Body = &progressSection{SectionReader: io.NewSectionReader(file, 0, size), progress: progress}
+	putInput.ContentLength = aws.Int64(size)
+	out, err := client.PutObject(ctx, &putInput)
+	if err != nil {
+		return nil, err
+	}
+	return &manager.UploadOutput{
+		ETag:                 out.ETag,
+		ServerSideEncryption: out.ServerSideEncryption,
+		VersionID:            out.VersionId,
+		Key:                  putInput.Key,
+	}, nil
+}
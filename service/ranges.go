@@ -0,0 +1,133 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"git.sr.ht/~ngraves/lfs-s3/api"
+)
+
+// rangePath returns where a range of oid is downloaded. Ranges are kept out
+// of the LFS store, which only holds whole objects.
+func rangePath(oid string, r *api.Range) string {
+	return filepath.Join(localTempDir("lfs-s3-ranges"), fmt.Sprintf("%s.%d-%d", oid, r.Offset, r.Offset+r.Length-1))
+}
+
+// checkRange checks that r is a non-empty range within an object of size
+// bytes, when the size is known.
+func checkRange(r *api.Range, size int64) error {
+	if r.Offset < 0 || r.Length <= 0 {
+		return fmt.Errorf("invalid range of %d bytes at %d", r.Length, r.Offset)
+	}
+	if size > 0 && r.Offset+r.Length > size {
+		return fmt.Errorf("range of %d bytes at %d is past the end of the %d bytes object", r.Length, r.Offset, size)
+	}
+	return nil
+}
+
+// retrieveRange downloads a range of an object, for callers which give one
+// with the download request, and reports its path back to lfs. The oid
+// can't be verified against a range, only the SHA-256 of the range when
+// it is given.
+func retrieveRange(oid string, size int64, r *api.Range, writer io.Writer, stderr io.Writer) {
+	start := time.Now()
+	localPath, err := downloadRange(context.Background(), oid, size, r, writer, stderr)
+	summary.record("download", r.Length, err)
+	if err != nil {
+		sendTransferError(oid, "Error downloading range", err, writer, stderr)
+		return
+	}
+
+	sendComplete(oid, localPath, writer, stderr)
+	notifyWebhook(oid, "download", r.Length, start, stderr)
+}
+
+func downloadRange(ctx context.Context, oid string, size int64, r *api.Range, writer io.Writer, stderr io.Writer) (string, error) {
+	if err := checkRange(r, size); err != nil {
+		return "", err
+	}
+	ctx, cancel, err := transferContext(ctx, r.Length)
+	if err != nil {
+		return "", err
+	}
+	defer cancel()
+
+	client, err := getS3Client()
+	if err != nil {
+		return "", fmt.Errorf("creating client: %w", err)
+	}
+	key, err := locateKey(ctx, client, oid)
+	if err != nil {
+		return "", err
+	}
+	versionID, err := pinnedVersion(oid)
+	if err != nil {
+		return "", err
+	}
+	fileMode, err := envFileMode("S3_OBJECT_FILE_MODE", defaultObjectFileMode)
+	if err != nil {
+		return "", err
+	}
+
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:    aws.String(os.Getenv("S3_BUCKET")),
+		Key:       aws.String(key),
+		VersionId: versionID,
+		Range:     aws.String(fmt.Sprintf("bytes=%d-%d", r.Offset, r.Offset+r.Length-1)),
+	})
+	if err != nil {
+		return "", err
+	}
+	defer out.Body.Close()
+
+	localPath := rangePath(oid, r)
+	if err := os.MkdirAll(filepath.Dir(localPath), 0777); err != nil {
+		return "", fmt.Errorf("creating directory: %w", err)
+	}
+	file, err := createUnique(filepath.Dir(localPath), filepath.Base(localPath)+".*.tmp", fileMode)
+	if err != nil {
+		return "", fmt.Errorf("creating file: %w", err)
+	}
+	stagedPath := file.Name()
+	defer func() {
+		file.Close()
+		os.Remove(stagedPath)
+	}()
+
+	progressReader, err := newProgressTracker(oid, r.Length, writer, stderr)
+	if err != nil {
+		return "", err
+	}
+	defer progressReader.stop()
+	// Read one byte past the range to notice a longer response.
+	progressReader.Reader = io.LimitReader(out.Body, r.Length+1)
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(file, hash), progressReader)
+	if err != nil {
+		return "", err
+	}
+	if written != r.Length {
+		return "", fmt.Errorf("received %d bytes for a range of %d", written, r.Length)
+	}
+	if r.Sha256 != "" {
+		if got := hex.EncodeToString(hash.Sum(nil)); got != r.Sha256 {
+			return "", fmt.Errorf("range has SHA-256 %s, expected %s", got, r.Sha256)
+		}
+	}
+	if err := file.Close(); err != nil {
+		return "", fmt.Errorf("closing file: %w", err)
+	}
+	if err := os.Rename(stagedPath, localPath); err != nil {
+		return "", fmt.Errorf("moving file into place: %w", err)
+	}
+	return localPath, nil
+}
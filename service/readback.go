@@ -0,0 +1,39 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// verifyReadback downloads an object just uploaded, if S3_VERIFY_READBACK is
+// set, and checks that what S3 serves back matches the oid.
+func verifyReadback(ctx context.Context, oid string, size int64, stderr io.Writer) error {
+	if !envBool("S3_VERIFY_READBACK") {
+		return nil
+	}
+	dir, err := os.MkdirTemp("", "lfs-s3-readback")
+	if err != nil {
+		return fmt.Errorf("creating read-back directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	localPath := filepath.Join(dir, oid)
+	err = readAfterWrite(ctx, func() error {
+		// Progress was already reported for the upload.
+		return downloadObject(ctx, oid, size, localPath, io.Discard, stderr)
+	})
+	if err != nil {
+		return fmt.Errorf("reading back: %w", err)
+	}
+	// The download is already verified unless S3_VERIFY leaves it out.
+	if !shouldVerify(verifyDownload) {
+		if err := verifyFile(localPath, oid); err != nil {
+			return fmt.Errorf("verifying read-back: %w", err)
+		}
+	}
+	fmt.Fprintf(stderr, "Read back and verified %s\n", oid)
+	return nil
+}
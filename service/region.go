@@ -0,0 +1,67 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	smithyauth "github.com/aws/smithy-go/auth"
+	smithyendpoints "github.com/aws/smithy-go/endpoints"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// isWrongRegion reports whether err means the bucket is in another region
+// than the one the request was sent to.
+func isWrongRegion(err error) bool {
+	return hasErrorCode(err, "PermanentRedirect", "AuthorizationHeaderMalformed", "IllegalLocationConstraintException")
+}
+
+// checkBucketRegion looks up the actual region of the bucket when err says
+// it lives in another region. The shared client is then recreated for that
+// region, so that retried and later transfers succeed, and the returned
+// error names it.
+func checkBucketRegion(ctx context.Context, err error, stderr io.Writer) error {
+	if !isWrongRegion(err) {
+		return err
+	}
+	client, clientErr := getS3Client()
+	if clientErr != nil {
+		return err
+	}
+	region, regionErr := manager.GetBucketRegion(ctx, client, os.Getenv("S3_BUCKET"))
+	if regionErr != nil {
+		fmt.Fprintf(stderr, "Unable to detect the region of the bucket: %v\n", regionErr)
+		return err
+	}
+
+	s3ClientMu.Lock()
+	bucketRegion = region
+	s3Client = nil
+	s3ClientMu.Unlock()
+	fmt.Fprintf(stderr, "Bucket is in region %s, using it from now on\n", region)
+	return fmt.Errorf("%w (the bucket is in region %s, set AWS_REGION=%s)", err, region, region)
+}
+
+// signingResolver signs requests for AWS_SIGNING_REGION rather than the
+// region of the client, for gateways and access points expecting another
+// one.
+type signingResolver struct {
+	next   s3.EndpointResolverV2
+	region string
+}
+
+func (r *signingResolver) ResolveEndpoint(ctx context.Context, params s3.EndpointParameters) (smithyendpoints.Endpoint, error) {
+	endpoint, err := r.next.ResolveEndpoint(ctx, params)
+	if err != nil {
+		return endpoint, err
+	}
+	options, _ := smithyauth.GetAuthOptions(&endpoint.Properties)
+	for _, option := range options {
+		smithyhttp.SetSigV4SigningRegion(&option.SignerProperties, r.region)
+		smithyhttp.SetSigV4ASigningRegions(&option.SignerProperties, []string{r.region})
+	}
+	return endpoint, nil
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	defaultRestoreDays  = 1
+	restorePollInterval = 30 * time.Second
+)
+
+// restoreSettings returns the retrieval tier and the number of days
+// archived objects are restored for, from S3_RESTORE_TIER and
+// S3_RESTORE_DAYS.
+func restoreSettings() (types.Tier, int32, error) {
+	tier := types.Tier(os.Getenv("S3_RESTORE_TIER"))
+	switch tier {
+	case "":
+		tier = types.TierStandard
+	case types.TierStandard, types.TierBulk, types.TierExpedited:
+	default:
+		return "", 0, fmt.Errorf("unknown tier %s in S3_RESTORE_TIER, expected Standard, Bulk or Expedited", tier)
+	}
+	days, err := envInt64("S3_RESTORE_DAYS", defaultRestoreDays)
+	if err != nil {
+		return "", 0, err
+	}
+	if days < 1 || days > 30000 {
+		return "", 0, fmt.Errorf("S3_RESTORE_DAYS must be between 1 and 30000")
+	}
+	return tier, int32(days), nil
+}
+
+// restoreArchived handles a download that failed because the object is in
+// an archive storage class. With S3_AUTO_RESTORE it requests a restore and,
+// if S3_RESTORE_WAIT is set, waits that long for it to complete before
+// downloading again. Other errors are returned as they are.
+func restoreArchived(ctx context.Context, oid string, size int64, localPath string, progress *progressTracker, stderr io.Writer, err error) error {
+	if !hasErrorCode(err, "InvalidObjectState") || !envBool("S3_AUTO_RESTORE") {
+		return err
+	}
+	tier, days, err := restoreSettings()
+	if err != nil {
+		return err
+	}
+	wait, err := envDuration("S3_RESTORE_WAIT", 0)
+	if err != nil {
+		return err
+	}
+	client, err := getS3Client()
+	if err != nil {
+		return fmt.Errorf("creating client: %w", err)
+	}
+	key, err := locateKey(ctx, client, oid)
+	if err != nil {
+		return err
+	}
+	bucket := os.Getenv("S3_BUCKET")
+
+	_, err = client.RestoreObject(ctx, &s3.RestoreObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		RestoreRequest: &types.RestoreRequest{
+			Days:                 aws.Int32(days),
+			GlacierJobParameters: &types.GlacierJobParameters{Tier: tier},
+		},
+	})
+	if err != nil && !hasErrorCode(err, "RestoreAlreadyInProgress") {
+		return fmt.Errorf("restoring archived object: %w", err)
+	}
+	fmt.Fprintf(stderr, "Restore of archived object %s requested with tier %s\n", oid, tier)
+
+	deadline := time.Now().Add(wait)
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(min(restorePollInterval, time.Until(deadline))):
+		}
+		head, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return fmt.Errorf("checking restore: %w", err)
+		}
+		if strings.Contains(aws.ToString(head.Restore), `ongoing-request="false"`) {
+			fmt.Fprintf(stderr, "Archived object %s restored\n", oid)
+			return downloadObjectFrom(ctx, bucket, oid, size, localPath, progress, stderr)
+		}
+	}
+	return fmt.Errorf("%s is archived, its restore was initiated, retry later", key)
+}
@@ -0,0 +1,220 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// uploadState is persisted after every part of a resumable upload, so that
+// a later run can carry on from the last completed part.
+type uploadState struct {
+	UploadID string                        `json:"uploadId"`
+	Key      string                        `json:"key"`
+	PartSize int64                         `json:"partSize"`
+	Checksum types.ChecksumAlgorithm       `json:"checksum,omitempty"`
+	Parts    map[int32]types.CompletedPart `json:"parts"`
+}
+
+// uploadStatePath returns where the state of the upload of oid is kept.
+func uploadStatePath(oid string) string {
+	return filepath.Join(localTempDir("lfs-s3-uploads"), oid+".json")
+}
+
+func loadUploadState(oid string) (*uploadState, error) {
+	data, err := os.ReadFile(uploadStatePath(oid))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state uploadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func saveUploadState(oid string, state *uploadState) error {
+	statePath := uploadStatePath(oid)
+	if err := os.MkdirAll(filepath.Dir(statePath), 0777); err != nil {
+		return err
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	// Write then rename, so a crash never leaves a truncated state behind.
+	tmpPath := statePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, statePath)
+}
+
+// listUploadedParts returns the parts S3 already holds for an upload.
+func listUploadedParts(ctx context.Context, client *s3.Client, bucket string, state *uploadState) (map[int32]types.CompletedPart, error) {
+	pageSize, err := listPageSize()
+	if err != nil {
+		return nil, err
+	}
+	parts := map[int32]types.CompletedPart{}
+	input := &s3.ListPartsInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(state.Key),
+		UploadId: aws.String(state.UploadID),
+		MaxParts: pageSize,
+	}
+	for {
+		page, err := client.ListParts(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range page.Parts {
+			parts[aws.ToInt32(part.PartNumber)] = types.CompletedPart{
+				PartNumber:        part.PartNumber,
+				ETag:              part.ETag,
+				ChecksumCRC32:     part.ChecksumCRC32,
+				ChecksumCRC32C:    part.ChecksumCRC32C,
+				ChecksumCRC64NVME: part.ChecksumCRC64NVME,
+				ChecksumSHA1:      part.ChecksumSHA1,
+				ChecksumSHA256:    part.ChecksumSHA256,
+			}
+		}
+		if !aws.ToBool(page.IsTruncated) {
+			return parts, nil
+		}
+		input.PartNumberMarker = page.NextPartNumberMarker
+	}
+}
+
+// resumableUpload uploads file in parts one at a time, recording each part
+// in a local state file. When a previous run left a state file for the same
+// key and part size, the parts S3 already holds are not uploaded again.
+func resumableUpload(ctx context.Context, client *s3.Client, input *s3.PutObjectInput, oid string, file io.ReaderAt, size int64, partSize int64, progress *progressTracker, stderr io.Writer) error {
+	bucket := aws.ToString(input.Bucket)
+	key := aws.ToString(input.Key)
+
+	state, err := loadUploadState(oid)
+	if err != nil {
+		fmt.Fprintf(stderr, "Ignoring unreadable upload state of %s: %v\n", oid, err)
+		state = nil
+	}
+	// Parts are checked with SHA-256 when S3_CHECKSUM_SHA256 asks for it,
+	// and with CRC32 otherwise, as the SDK would. A client only sending
+	// checksums when required, such as after S3_CHECKSUM_AUTOFALLBACK,
+	// sends none.
+	checksum := input.ChecksumAlgorithm
+	if checksum == "" && client.Options().RequestChecksumCalculation != aws.RequestChecksumCalculationWhenRequired {
+		checksum = types.ChecksumAlgorithmCrc32
+	}
+	if state != nil && (state.Key != key || state.PartSize != partSize || state.Checksum != checksum) {
+		state = nil
+	}
+	if state != nil {
+		parts, err := listUploadedParts(ctx, client, bucket, state)
+		if err != nil {
+			if !isNotFound(err) {
+				return err
+			}
+			// The upload was aborted or completed meanwhile.
+			state = nil
+		} else {
+			fmt.Fprintf(stderr, "Resuming upload %s of %s with %d parts done\n", state.UploadID, oid, len(parts))
+			state.Parts = parts
+		}
+	}
+	if state == nil {
+		created, err := client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+			Bucket:               input.Bucket,
+			Key:                  input.Key,
+			StorageClass:         input.StorageClass,
+			ContentDisposition:   input.ContentDisposition,
+			Metadata:             input.Metadata,
+			ServerSideEncryption: input.ServerSideEncryption,
+			SSEKMSKeyId:          input.SSEKMSKeyId,
+			ChecksumAlgorithm:    checksum,
+		})
+		if err != nil {
+			return err
+		}
+		state = &uploadState{
+			UploadID: aws.ToString(created.UploadId),
+			Key:      key,
+			PartSize: partSize,
+			Checksum: checksum,
+			Parts:    map[int32]types.CompletedPart{},
+		}
+		if err := saveUploadState(oid, state); err != nil {
+			return fmt.Errorf("saving upload state: %w", err)
+		}
+	}
+
+	partCount := int32((size + partSize - 1) / partSize)
+	for number := int32(1); number <= partCount; number++ {
+		offset := int64(number-1) * partSize
+		length := min(partSize, size-offset)
+		if _, done := state.Parts[number]; !done {
+			uploaded, err := client.UploadPart(ctx, &s3.UploadPartInput{
+				Bucket:            input.Bucket,
+				Key:               input.Key,
+				UploadId:          aws.String(state.UploadID),
+				PartNumber:        aws.Int32(number),
+				Body:              io.NewSectionReader(file, offset, length),
+				ContentLength:     aws.Int64(length),
+				ChecksumAlgorithm: checksum,
+			})
+			if err != nil {
+				return err
+			}
+			state.Parts[number] = types.CompletedPart{
+				PartNumber:        aws.Int32(number),
+				ETag:              uploaded.ETag,
+				ChecksumCRC32:     uploaded.ChecksumCRC32,
+				ChecksumCRC32C:    uploaded.ChecksumCRC32C,
+				ChecksumCRC64NVME: uploaded.ChecksumCRC64NVME,
+				ChecksumSHA1:      uploaded.ChecksumSHA1,
+				ChecksumSHA256:    uploaded.ChecksumSHA256,
+			}
+			if err := saveUploadState(oid, state); err != nil {
+				return fmt.Errorf("saving upload state: %w", err)
+			}
+		}
+		if err := progress.report(int(length)); err != nil {
+			return err
+		}
+	}
+
+	completed := make([]types.CompletedPart, 0, len(state.Parts))
+	for _, part := range state.Parts {
+		completed = append(completed, part)
+	}
+	sort.Slice(completed, func(i, j int) bool {
+		return aws.ToInt32(completed[i].PartNumber) < aws.ToInt32(completed[j].PartNumber)
+	})
+	_, err = client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          input.Bucket,
+		Key:             input.Key,
+		UploadId:        aws.String(state.UploadID),
+		IfNoneMatch:     input.IfNoneMatch,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(uploadStatePath(oid)); err != nil {
+		fmt.Fprintf(stderr, "Unable to remove upload state of %s: %v\n", oid, err)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResumableUploadChecksumFallback(t *testing.T) {
+	fake := startFakeS3(t, "bucket")
+	fake.rejectChecksums = true
+	unsetenv(t, "AWS_REQUEST_CHECKSUM_CALCULATION", "S3_CHECKSUM_SHA256", "S3_COMPOSITE_THRESHOLD",
+		"S3_PREFIX_DATE", "S3_SKIP_EXISTING", "S3_UPLOAD_PART_SIZE")
+	t.Setenv("S3_PREFIX", "lfs")
+	t.Setenv("S3_RESUMABLE_UPLOAD", "true")
+	t.Setenv("S3_CHECKSUM_AUTOFALLBACK", "true")
+	t.Setenv("LFS_S3_OBJECTS_ROOT", t.TempDir())
+
+	data := bytes.Repeat([]byte("resumable "), 600*1024)
+	sum := sha256.Sum256(data)
+	oid := hex.EncodeToString(sum[:])
+	src := filepath.Join(t.TempDir(), "src")
+	if err := os.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := uploadObject(context.Background(), oid, int64(len(data)), src, io.Discard, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if fake.rejected == 0 {
+		t.Error("the first attempt sent no checksums, nothing was retried")
+	}
+	object := fake.objects["lfs/"+oid]
+	if object == nil || !bytes.Equal(object.data, data) {
+		t.Errorf("stored %v, want the object uploaded in parts without checksums", fake.keys())
+	}
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+)
+
+// retryableCodes parses S3_RETRYABLE_CODES, a comma-separated list of HTTP
+// status codes and S3 error codes which should be retried on top of the
+// SDK defaults.
+func retryableCodes() []retry.IsErrorRetryable {
+	statusCodes := map[int]struct{}{}
+	errorCodes := map[string]struct{}{}
+	for _, code := range strings.Split(os.Getenv("S3_RETRYABLE_CODES"), ",") {
+		code = strings.TrimSpace(code)
+		if code == "" {
+			continue
+		}
+		if status, err := strconv.Atoi(code); err == nil {
+			statusCodes[status] = struct{}{}
+		} else {
+			errorCodes[code] = struct{}{}
+		}
+	}
+
+	var retryables []retry.IsErrorRetryable
+	if len(statusCodes) > 0 {
+		retryables = append(retryables, retry.RetryableHTTPStatusCode{Codes: statusCodes})
+	}
+	if len(errorCodes) > 0 {
+		retryables = append(retryables, retry.RetryableErrorCode{Codes: errorCodes})
+	}
+	return retryables
+}
+
+// newRetryer builds the retry strategy of the S3 client.
+func newRetryer() aws.Retryer {
+	extra := retryableCodes()
+	backoff, err := slowDownBackoffBase()
+	if err != nil {
+		backoff = defaultSlowDownBackoff
+	}
+	return retry.NewStandard(func(o *retry.StandardOptions) {
+		// Checked before the defaults, which may rule the codes out.
+		o.Retryables = append(extra, o.Retryables...)
+		// The SDK only fills in its default backoff after the options.
+		fallback := o.Backoff
+		if fallback == nil {
+			fallback = retry.NewExponentialJitterBackoff(o.MaxBackoff)
+		}
+		o.Backoff = &slowDownBackoff{fallback: fallback, base: backoff}
+	})
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const selfTestSize = 1024
+
+// SelfTest uploads a small random object, downloads it back, checks its oid
+// and deletes it, printing PASS or FAIL for each step to stdout. It returns
+// false if any step failed.
+func SelfTest(stdout, stderr io.Writer) bool {
+	ctx := context.Background()
+
+	run := func(name string, fn func() error) bool {
+		start := time.Now()
+		err := fn()
+		elapsed := time.Since(start).Round(time.Millisecond)
+		if err != nil {
+			fmt.Fprintf(stdout, "%-10s FAIL %v: %s\n", name, elapsed, describeError(err))
+			return false
+		}
+		fmt.Fprintf(stdout, "%-10s PASS %v\n", name, elapsed)
+		return true
+	}
+
+	if !run("config", checkConfig) {
+		return false
+	}
+
+	dir, err := os.MkdirTemp("", "lfs-s3-selftest")
+	if err != nil {
+		fmt.Fprintf(stdout, "Unable to create temporary directory: %v\n", err)
+		return false
+	}
+	defer os.RemoveAll(dir)
+
+	content := make([]byte, selfTestSize)
+	if _, err := rand.Read(content); err != nil {
+		fmt.Fprintf(stdout, "Unable to generate test content: %v\n", err)
+		return false
+	}
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+	uploadPath := filepath.Join(dir, "upload")
+	downloadPath := filepath.Join(dir, "download")
+	if err := os.WriteFile(uploadPath, content, 0644); err != nil {
+		fmt.Fprintf(stdout, "Unable to write test content: %v\n", err)
+		return false
+	}
+
+	passed := run("upload", func() error {
+		return uploadObject(ctx, oid, selfTestSize, uploadPath, io.Discard, stderr)
+	})
+	if passed {
+		passed = run("download", func() error {
+			return readAfterWrite(ctx, func() error {
+				return downloadObject(ctx, oid, selfTestSize, downloadPath, io.Discard, stderr)
+			})
+		}) && run("verify", func() error {
+			return verifyFile(downloadPath, oid)
+		})
+		// Always try to clean up once something was uploaded.
+		passed = run("delete", func() error {
+			return deleteObject(ctx, oid)
+		}) && passed
+	}
+
+	if passed {
+		fmt.Fprintf(stdout, "PASS\n")
+	} else {
+		fmt.Fprintf(stdout, "FAIL\n")
+	}
+	return passed
+}
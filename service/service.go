@@ -3,76 +3,254 @@ package service
 import (
 	"bufio"
 	"context"
+	"crypto/md5"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go/middleware"
 
 	"git.sr.ht/~ngraves/lfs-s3/api"
 )
 
-type writerAtWrapper struct {
-	w io.Writer
+func checkEnvVars(vars []string) error {
+	for _, v := range vars {
+		if value := os.Getenv(v); value == "" {
+			return fmt.Errorf("environment variable %s not defined", v)
+		}
+	}
+	return nil
 }
 
-func (waw *writerAtWrapper) WriteAt(p []byte, off int64) (n int, err error) {
-	return waw.w.Write(p)
+// checkConfig validates the environment before any transfer starts.
+func checkConfig() error {
+	requiredVars := []string{
+		"S3_BUCKET",
+	}
+	if err := checkEnvVars(requiredVars); err != nil {
+		return err
+	}
+	if _, err := getStorageClass(); err != nil {
+		return err
+	}
+	if err := checkS3Express(); err != nil {
+		return err
+	}
+	if err := checkAccessPoint(); err != nil {
+		return err
+	}
+	if _, err := uploadPartSize(); err != nil {
+		return err
+	}
+	if _, err := downloadPartSize(); err != nil {
+		return err
+	}
+	if _, err := newHTTPClient(); err != nil {
+		return err
+	}
+	if _, err := envInt64("S3_WRITE_BUFFER_SIZE", defaultWriteBufferSize); err != nil {
+		return err
+	}
+	if _, err := envDuration("S3_PROGRESS_INTERVAL", defaultProgressInterval); err != nil {
+		return err
+	}
+	if _, err := progressFlushInterval(); err != nil {
+		return err
+	}
+	if _, err := envInt64("S3_MIN_RATE", 0); err != nil {
+		return err
+	}
+	if _, err := envDuration("S3_TRANSFER_BASELINE", defaultTransferBaseline); err != nil {
+		return err
+	}
+	if _, err := apiCallTimeout(); err != nil {
+		return err
+	}
+	if _, err := loadPinnedVersions(); err != nil {
+		return err
+	}
+	if _, err := listPageSize(); err != nil {
+		return err
+	}
+	if _, err := concurrencyRamp(); err != nil {
+		return err
+	}
+	if _, err := s3Endpoint(); err != nil {
+		return err
+	}
+	if _, err := clockSkewCorrection(); err != nil {
+		return err
+	}
+	if _, err := getManifestMode(); err != nil {
+		return err
+	}
+	if _, err := loadKMSKeyMap(); err != nil {
+		return err
+	}
+	if _, err := expectedBucketOwner(); err != nil {
+		return err
+	}
+	if _, err := credentialRefreshWindow(); err != nil {
+		return err
+	}
+	if os.Getenv("S3_CREDENTIALS_JSON") != "" {
+		if _, err := loadJSONCredentials(); err != nil {
+			return err
+		}
+	}
+	if _, err := getVerifyMode(); err != nil {
+		return err
+	}
+	if _, err := globalConcurrency(); err != nil {
+		return err
+	}
+	if _, err := envInt64("S3_MAX_MEMORY", 0); err != nil {
+		return err
+	}
+	if _, err := envOptionalBool("S3_USEPATHSTYLE"); err != nil {
+		return err
+	}
+	for _, name := range []string{"S3_PREFIX", "S3_AUDIT_PREFIX"} {
+		if _, err := envExpanded(name); err != nil {
+			return err
+		}
+	}
+	if _, err := compositeThreshold(); err != nil {
+		return err
+	}
+	if _, err := envInt64("S3_READ_CONSISTENCY_RETRIES", 0); err != nil {
+		return err
+	}
+	if _, err := keySuffix(); err != nil {
+		return err
+	}
+	if _, err := sanitizeKeyPrefix(""); err != nil {
+		return err
+	}
+	if os.Getenv("S3_PREFIX") != "" {
+		if _, err := objectKey(strings.Repeat("0", 64)); err != nil {
+			return err
+		}
+	}
+	if _, _, err := getModes(); err != nil {
+		return err
+	}
+	if _, _, err := restoreSettings(); err != nil {
+		return err
+	}
+	if _, err := missingObjectBehavior(); err != nil {
+		return err
+	}
+	if _, err := envDuration("S3_RESTORE_WAIT", 0); err != nil {
+		return err
+	}
+	if _, err := slowDownBackoffBase(); err != nil {
+		return err
+	}
+	if _, err := extraHeaders(); err != nil {
+		return err
+	}
+	if _, err := webhookURL(); err != nil {
+		return err
+	}
+	if _, err := envDuration("LFS_S3_WEBHOOK_TIMEOUT", defaultWebhookTimeout); err != nil {
+		return err
+	}
+	if _, err := diskWriteQueue(); err != nil {
+		return err
+	}
+	if _, err := completeRetries(); err != nil {
+		return err
+	}
+	if _, err := headConcurrency(); err != nil {
+		return err
+	}
+	if _, err := partConcurrency(0, 1); err != nil {
+		return err
+	}
+	if _, err := maxObjects(); err != nil {
+		return err
+	}
+	if _, err := envDuration("LFS_S3_TERMINATE_TIMEOUT", defaultTerminateTimeout); err != nil {
+		return err
+	}
+	if _, err := envFileMode("S3_OBJECT_FILE_MODE", defaultObjectFileMode); err != nil {
+		return err
+	}
+	if _, err := envFileMode("S3_OBJECT_DIR_MODE", defaultObjectDirMode); err != nil {
+		return err
+	}
+	return nil
 }
 
-type progressTracker struct {
-	Reader         io.Reader
-	Writer         io.WriterAt
-	Oid            string
-	TotalSize      int64
-	RespWriter     io.Writer
-	ErrWriter      io.Writer
-	bytesProcessed int64
+// syncWriter serializes writes from concurrent transfers, so each response
+// stays on its own line.
+type syncWriter struct {
+	mu        sync.Mutex
+	w         io.Writer
+	terminals *terminalGuard
 }
 
-func (rw *progressTracker) Read(p []byte) (n int, err error) {
-	n, err = rw.Reader.Read(p)
-	if n > 0 {
-		rw.bytesProcessed += int64(n)
-		api.SendProgress(rw.Oid, rw.bytesProcessed, n, rw.RespWriter, rw.ErrWriter)
-	}
-	return
+func (sw *syncWriter) Write(p []byte) (n int, err error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.w.Write(p)
 }
 
-func (rw *progressTracker) WriteAt(p []byte, off int64) (n int, err error) {
-	n, err = rw.Writer.WriteAt(p, off)
-	if n > 0 {
-		rw.bytesProcessed += int64(n)
-		api.SendProgress(rw.Oid, rw.bytesProcessed, n, rw.RespWriter, rw.ErrWriter)
+const defaultTerminateTimeout = 30 * time.Second
+
+// Permissions of downloaded objects, before the umask is applied.
+const (
+	defaultObjectFileMode = 0666
+	defaultObjectDirMode  = 0777
+)
+
+// maxObjects returns how many transfers a session may process, 0 meaning no
+// limit.
+func maxObjects() (int64, error) {
+	limit, err := envInt64("LFS_S3_MAX_OBJECTS", 0)
+	if err != nil {
+		return 0, err
+	}
+	if limit < 0 {
+		return 0, fmt.Errorf("LFS_S3_MAX_OBJECTS must not be negative")
 	}
-	return
+	return limit, nil
 }
 
-func checkEnvVars(vars []string) error {
-	for _, v := range vars {
-		if value := os.Getenv(v); value == "" {
-			return fmt.Errorf("environment variable %s not defined", v)
-		}
+// countTransfer counts one more transfer of the session, failing once limit
+// transfers were already accepted.
+func countTransfer(transfers *int64, limit int64) error {
+	if limit > 0 && *transfers >= limit {
+		return fmt.Errorf("the session already processed %d objects, the LFS_S3_MAX_OBJECTS limit", limit)
 	}
+	*transfers++
 	return nil
 }
 
 func Serve(stdin io.Reader, stdout, stderr io.Writer) {
-	requiredVars := []string{
-		"S3_BUCKET",
-	}
-
 	scanner := bufio.NewScanner(stdin)
-	writer := io.Writer(stdout)
+	writer := &syncWriter{w: stdout, terminals: newTerminalGuard()}
+	mode, access := modeAuto, accessReadWrite
+	var limit, transfers int64
+	var inflight sync.WaitGroup
+	defer summary.write(stderr)
+	defer closeIdleConnections()
+	defer waitForTransfers(&inflight, stderr)
 
 scanner:
 	for scanner.Scan() {
@@ -85,7 +263,7 @@ scanner:
 
 		switch req.Event {
 		case "init":
-			if err := checkEnvVars(requiredVars); err != nil {
+			if err := checkConfig(); err != nil {
 				errorResp := &api.InitResponse{
 					Error: &api.Error{
 						Code:    1,
@@ -95,14 +273,58 @@ scanner:
 				api.SendResponse(errorResp, writer, stderr)
 				return
 			}
+			logConfig(stderr)
+			mode, access, _ = getModes()
+			limit, _ = maxObjects()
+			if req.Remote != "" {
+				fmt.Fprintf(stderr, "Serving %s for remote %s\n", req.Operation, req.Remote)
+			}
 			resp := &api.InitResponse{}
 			api.SendResponse(resp, writer, stderr)
 		case "download":
 			fmt.Fprintf(stderr, "Received download request for %s\n", req.Oid)
-			retrieve(req.Oid, req.Size, writer, stderr)
+			writer.terminals.expect(req.Oid)
+			if err := checkEvent(access, req.Event); err != nil {
+				sendTransferError(req.Oid, "Refusing download", err, writer, stderr)
+				continue
+			}
+			if err := checkAction(mode, &req, stderr); err != nil {
+				sendTransferError(req.Oid, "Error checking request", err, writer, stderr)
+				continue
+			}
+			if err := countTransfer(&transfers, limit); err != nil {
+				sendTransferError(req.Oid, "Refusing download", err, writer, stderr)
+				continue
+			}
+			inflight.Add(1)
+			go func() {
+				defer inflight.Done()
+				if req.Range != nil {
+					retrieveRange(req.Oid, req.Size, req.Range, writer, stderr)
+					return
+				}
+				retrieve(req.Oid, req.Size, writer, stderr)
+			}()
 		case "upload":
 			fmt.Fprintf(stderr, "Received upload request for %s\n", req.Oid)
-			store(req.Oid, req.Size, writer, stderr)
+			writer.terminals.expect(req.Oid)
+			if err := checkEvent(access, req.Event); err != nil {
+				sendTransferError(req.Oid, "Refusing upload", err, writer, stderr)
+				continue
+			}
+			if err := checkAction(mode, &req, stderr); err != nil {
+				sendTransferError(req.Oid, "Error checking request", err, writer, stderr)
+				continue
+			}
+			if err := countTransfer(&transfers, limit); err != nil {
+				sendTransferError(req.Oid, "Refusing upload", err, writer, stderr)
+				continue
+			}
+			inflight.Add(1)
+			go func() {
+				defer inflight.Done()
+				store(req.Oid, req.Size, writer, stderr)
+			}()
 		case "terminate":
 			fmt.Fprintf(stderr, "Terminating test custom adapter gracefully.\n")
 			break scanner
@@ -110,155 +332,759 @@ scanner:
 	}
 }
 
+// waitForTransfers lets in-flight transfers send their responses before
+// exiting, for at most LFS_S3_TERMINATE_TIMEOUT.
+func waitForTransfers(inflight *sync.WaitGroup, stderr io.Writer) {
+	timeout, err := envDuration("LFS_S3_TERMINATE_TIMEOUT", defaultTerminateTimeout)
+	if err != nil {
+		fmt.Fprintf(stderr, "%v, using %v\n", err, defaultTerminateTimeout)
+		timeout = defaultTerminateTimeout
+	}
+
+	done := make(chan struct{})
+	go func() {
+		inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		fmt.Fprintf(stderr, "Transfers still running after %v, exiting anyway\n", timeout)
+	}
+}
+
+// Version of lfs-s3, reported in the User-Agent of requests.
+var Version = "Custom build"
+
+// DebugLog receives diagnostics from code which is shared by all transfers,
+// such as the HTTP client, and has no stderr of its own.
+var DebugLog io.Writer = io.Discard
+
+// appID identifies lfs-s3 traffic in the User-Agent, for instance in server
+// access logs, along with the optional LFS_S3_UA_SUFFIX. The SDK replaces
+// characters not allowed there, such as spaces and slashes, by dashes.
+func appID() string {
+	id := "lfs-s3#" + Version
+	if suffix := os.Getenv("LFS_S3_UA_SUFFIX"); suffix != "" {
+		id += "_" + suffix
+	}
+	return id
+}
+
+var (
+	s3ClientMu sync.Mutex
+	s3Client   *s3.Client
+	// Region of the bucket, when it turned out to differ from AWS_REGION.
+	bucketRegion string
+	// Transport of s3Client, kept to close its idle connections.
+	s3Transport *http.Transport
+)
+
+// getS3Client returns the client shared by all transfers, so connections
+// are reused between objects.
+func getS3Client() (*s3.Client, error) {
+	s3ClientMu.Lock()
+	defer s3ClientMu.Unlock()
+	if s3Client == nil {
+		client, err := createS3Client()
+		if err != nil {
+			return nil, err
+		}
+		s3Client = client
+	}
+	return s3Client, nil
+}
+
+// closeIdleConnections releases the connections of the client once the
+// transfers are done, so that the process exits without leaving them to
+// the operating system.
+func closeIdleConnections() {
+	s3ClientMu.Lock()
+	defer s3ClientMu.Unlock()
+	if s3Transport != nil {
+		s3Transport.CloseIdleConnections()
+	}
+}
+
 func createS3Client() (*s3.Client, error) {
 	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		// Regional endpoints sign with their own region.
+		region = endpointRegion()
+	}
+	if accessPoint, ok := accessPointARN(); ok && region == "" {
+		region = accessPoint.Region
+		if region == "" {
+			// Multi-Region Access Points are signed for all regions, but
+			// the client still needs one.
+			region = "us-east-1"
+		}
+	}
+	if bucketRegion != "" {
+		region = bucketRegion
+	}
 	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
 	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
 	profile := os.Getenv("AWS_PROFILE")
 
-	var cfg aws.Config
-	var err error
+	buildable, err := newHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	httpClient, transport := ownedClient(buildable)
+	if s3Transport != nil {
+		// The client is being replaced, after a region change.
+		s3Transport.CloseIdleConnections()
+	}
+	s3Transport = transport
+
+	limitedClient, err := limitRequests(httpClient)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []func(*config.LoadOptions) error{
+		config.WithRegion(region),
+		config.WithHTTPClient(limitedClient),
+		config.WithAppID(appID()),
+		config.WithRetryer(newRetryer),
+	}
+
+	apiOptions := []func(*middleware.Stack) error{logClockSkew}
+	timeout, err := apiCallTimeout()
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		apiOptions = append(apiOptions, withAPICallTimeout(timeout))
+	}
+	headers, err := extraHeaders()
+	if err != nil {
+		return nil, err
+	}
+	if len(headers) > 0 {
+		apiOptions = append(apiOptions, withExtraHeaders(headers))
+	}
+	owner, err := expectedBucketOwner()
+	if err != nil {
+		return nil, err
+	}
+	if owner != "" {
+		apiOptions = append(apiOptions, withExpectedBucketOwner(owner))
+	}
+	retries, err := completeRetries()
+	if err != nil {
+		return nil, err
+	}
+	if retries > 0 {
+		apiOptions = append(apiOptions, withCompleteRetries(retries))
+	}
+	heads, err := headConcurrency()
+	if err != nil {
+		return nil, err
+	}
+	if heads > 0 {
+		apiOptions = append(apiOptions, withHeadLimit(heads))
+	}
+	endpoints, err := s3Endpoints()
+	if err != nil {
+		return nil, err
+	}
+	var failover *endpointFailover
+	if len(endpoints) > 1 {
+		failover = &endpointFailover{endpoints: endpoints}
+		apiOptions = append(apiOptions, withEndpointFailover(failover))
+	}
+	opts = append(opts, config.WithAPIOptions(apiOptions))
 
 	if len(profile) > 0 {
 		// Profile wins if it's defined.
-		cfg, err = config.LoadDefaultConfig(context.TODO(),
-			config.WithSharedConfigProfile(profile),
-			config.WithRegion(region),
-		)
-	} else {
+		opts = append(opts, config.WithSharedConfigProfile(profile))
+		opts = append(opts, mfaOptions()...)
+	} else if len(accessKey) > 0 && len(secretKey) > 0 {
 		// Else fall back to access and secret keys.
-		cfg, err = config.LoadDefaultConfig(context.TODO(),
-			config.WithRegion(region),
-			config.WithCredentialsProvider(aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
-				return aws.Credentials{
-					AccessKeyID:     accessKey,
-					SecretAccessKey: secretKey,
-				}, nil
-			})),
-		)
+		opts = append(opts, config.WithCredentialsProvider(aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{
+				AccessKeyID:     accessKey,
+				SecretAccessKey: secretKey,
+				SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+			}, nil
+		})))
+	} else if os.Getenv("S3_CREDENTIALS_JSON") != "" {
+		// Else use the credentials file of the provider.
+		opts = append(opts, config.WithCredentialsProvider(jsonCredentialsProvider()))
+	}
+	// Otherwise the default chain applies, including credential_process,
+	// SSO and instance roles from the default profile.
+	refreshWindow, err := credentialRefreshWindow()
+	if err != nil {
+		return nil, err
+	}
+	if refreshWindow > 0 {
+		opts = append(opts, config.WithCredentialsCacheOptions(withRefreshWindow(refreshWindow)))
 	}
 
+	cfg, err := config.LoadDefaultConfig(context.TODO(), opts...)
 	if err != nil {
 		return nil, err
 	}
+	if len(profile) > 0 && os.Getenv("AWS_MFA_TOKEN") != "" {
+		cfg.Credentials = aws.NewCredentialsCache(&mfaCacheProvider{next: cfg.Credentials, path: mfaCachePath()}, withRefreshWindow(refreshWindow))
+	}
+
+	usePathStyle, err := envOptionalBool("S3_USEPATHSTYLE")
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := s3Endpoint()
+	if err != nil {
+		return nil, err
+	}
+	skewCorrection, err := clockSkewCorrection()
+	if err != nil {
+		return nil, err
+	}
+	signingRegion := os.Getenv("AWS_SIGNING_REGION")
 
 	return s3.NewFromConfig(cfg, func(o *s3.Options) {
-		usePathStyle, err := strconv.ParseBool(os.Getenv("S3_USEPATHSTYLE"))
-		if err != nil {
-			usePathStyle = false
+		if endpoint != nil {
+			o.BaseEndpoint = endpoint
+		}
+		o.DisableClockSkewCorrection = !skewCorrection
+		// Keep the SDK default, virtual-hosted addressing, unless set.
+		if usePathStyle != nil {
+			o.UsePathStyle = *usePathStyle
+		}
+		if _, ok := accessPointARN(); ok {
+			// Access points are only reachable with virtual-hosted
+			// addressing, in the region of their ARN.
+			o.UsePathStyle = false
+			o.UseARNRegion = true
+		} else if useS3Express() {
+			// Directory buckets are only reachable with virtual-hosted
+			// addressing and session based authentication.
+			o.UsePathStyle = false
+			o.DisableS3ExpressSessionAuth = aws.Bool(false)
+		}
+		if signingRegion != "" {
+			next := o.EndpointResolverV2
+			if next == nil {
+				next = s3.NewDefaultEndpointResolverV2()
+			}
+			o.EndpointResolverV2 = &signingResolver{next: next, region: signingRegion}
+		}
+		if failover != nil {
+			next := o.EndpointResolverV2
+			if next == nil {
+				next = s3.NewDefaultEndpointResolverV2()
+			}
+			o.EndpointResolverV2 = &failoverResolver{next: next, failover: failover}
 		}
-		o.UsePathStyle = usePathStyle
 	}), nil
 }
 
+// localObjectPath returns where git-lfs keeps the object with the given oid,
+// under LFS_S3_OBJECTS_ROOT when set.
+func localObjectPath(oid string) string {
+	if root := os.Getenv("LFS_S3_OBJECTS_ROOT"); root != "" {
+		return filepath.Join(root, oid[:2], oid[2:4], oid)
+	}
+	return ".git/lfs/objects/" + oid[:2] + "/" + oid[2:4] + "/" + oid
+}
+
+// localTempDir returns where lfs-s3 keeps the named kind of temporary
+// files, next to the objects of git-lfs in .git/lfs/tmp, or under
+// LFS_S3_OBJECTS_ROOT when set.
+func localTempDir(name string) string {
+	if root := os.Getenv("LFS_S3_OBJECTS_ROOT"); root != "" {
+		return filepath.Join(root, "tmp", name)
+	}
+	return filepath.Join(".git", "lfs", "tmp", name)
+}
+
+// objectKeyPrefix returns the prefix shared by the keys of all objects of
+// the repository, S3_PREFIX or else the name of the repository.
+func objectKeyPrefix() (string, error) {
+	prefix, err := envExpanded("S3_PREFIX")
+	if err != nil {
+		return "", err
+	}
+	if prefix == "" {
+		prefix, err = getGitRepoName()
+		if err != nil {
+			return "", fmt.Errorf("getting git repo name from cwd: %w", err)
+		}
+	}
+	prefix, err = sanitizeKeyPrefix(strings.Trim(prefix, "/"))
+	if err != nil {
+		return "", err
+	}
+	return prefix + "/", nil
+}
+
+// objectKey returns the bucket key of the object with the given oid.
+func objectKey(oid string) (string, error) {
+	keyPrefix, err := objectKeyPrefix()
+	if err != nil {
+		return "", err
+	}
+	suffix, err := keySuffix()
+	if err != nil {
+		return "", err
+	}
+	key := path.Join(keyPrefix, oid+suffix)
+	return key, validateKey(key)
+}
+
 func retrieve(oid string, size int64, writer io.Writer, stderr io.Writer) {
-	client, err := createS3Client()
+	start := time.Now()
+	localPath, err := fetchObject(oid, size, writer, stderr)
 	if err != nil {
-		fmt.Fprintf(stderr, "Error creating client: %v\n", err)
+		sendTransferError(oid, "Error downloading file", err, writer, stderr)
 		return
 	}
-	bucketName := os.Getenv("S3_BUCKET")
-	keyPrefix, err := getGitRepoName()
+	sendComplete(oid, localPath, writer, stderr)
+	notifyWebhook(oid, "download", size, start, stderr)
+}
+
+// fetchObject downloads an object into the local LFS store, falling back
+// to restoring it, to the mirror or to an empty file as configured, and
+// returns its path.
+func fetchObject(oid string, size int64, writer io.Writer, stderr io.Writer) (string, error) {
+	localPath := localObjectPath(oid)
+	unlock, err := lockObject(oid, localPath)
 	if err != nil {
-		fmt.Fprintf(stderr, "Error getting git repo name from cwd: %v\n", err)
-		return
+		return "", err
+	}
+	defer unlock()
+	if envBool("LFS_S3_LOCK_DOWNLOADS") && downloadedMeanwhile(localPath, size) {
+		fmt.Fprintf(stderr, "Object %s was downloaded by another process\n", oid)
+		return localPath, nil
+	}
+	// The attempts share a tracker, so that the progress of a fallback picks
+	// up where the failed attempt left it.
+	progress, err := newProgressTracker(oid, size, writer, stderr)
+	if err != nil {
+		return "", err
+	}
+	defer progress.stop()
+	endMarker := markTransfer(oid, "download", size, stderr)
+	err = downloadObjectFrom(context.Background(), os.Getenv("S3_BUCKET"), oid, size, localPath, progress, stderr)
+	if err != nil {
+		err = restoreArchived(context.Background(), oid, size, localPath, progress, stderr, err)
+	}
+	if err != nil {
+		err = downloadFromMirror(context.Background(), oid, size, localPath, progress, stderr, err)
+	}
+	if err != nil {
+		err = emptyIfMissing(oid, localPath, stderr, err)
+	}
+	endMarker(err)
+	summary.record("download", size, err)
+	if err != nil {
+		return "", checkBucketRegion(context.Background(), err, stderr)
 	}
 
-	localPath := ".git/lfs/objects/" + oid[:2] + "/" + oid[2:4] + "/" + oid
-	file, err := os.Create(localPath)
+	recordTransfer(oid, size, "download", stderr)
+	return localPath, nil
+}
+
+// downloadObject fetches an object from the bucket into localPath, reporting
+// progress to writer.
+func downloadObject(ctx context.Context, oid string, size int64, localPath string, writer io.Writer, stderr io.Writer) error {
+	progress, err := newProgressTracker(oid, size, writer, stderr)
 	if err != nil {
-		fmt.Fprintf(stderr, "Error creating file: %v\n", err)
-		return
+		return err
+	}
+	defer progress.stop()
+	return downloadObjectFrom(ctx, os.Getenv("S3_BUCKET"), oid, size, localPath, progress, stderr)
+}
+
+// downloadObjectFrom fetches an object from bucketName into localPath,
+// reporting progress to progress. The bytes the tracker already reported
+// in an earlier attempt are not reported again.
+func downloadObjectFrom(ctx context.Context, bucketName string, oid string, size int64, localPath string, progress *progressTracker, stderr io.Writer) error {
+	ctx, cancel, err := transferContext(ctx, size)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	client, err := getS3Client()
+	if err != nil {
+		return fmt.Errorf("creating client: %w", err)
+	}
+	key, err := locateKey(ctx, client, oid)
+	if err != nil {
+		return err
+	}
+
+	versionID, err := pinnedVersion(oid)
+	if err != nil {
+		return err
+	}
+
+	partSize, err := downloadPartSize()
+	if err != nil {
+		return err
+	}
+
+	bufferSize, err := envInt64("S3_WRITE_BUFFER_SIZE", defaultWriteBufferSize)
+	if err != nil {
+		return err
+	}
+
+	fileMode, err := envFileMode("S3_OBJECT_FILE_MODE", defaultObjectFileMode)
+	if err != nil {
+		return err
+	}
+	dirMode, err := envFileMode("S3_OBJECT_DIR_MODE", defaultObjectDirMode)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(localPath), dirMode); err != nil {
+		return fmt.Errorf("creating directory: %w", err)
 	}
+	queue, err := diskWriteQueue()
+	if err != nil {
+		return err
+	}
+	// Each queued write holds a copy of at most the write buffer.
+	release, err := reserveMemory(ctx, bufferSize*(1+queue))
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// Download to a staging file, so an interrupted download never leaves a
+	// partial object in place.
+	if err := checkDiskSpace(stageDir(localPath), size); err != nil {
+		return err
+	}
+	file, err := createStaged(oid, localPath, fileMode)
+	if err != nil {
+		return fmt.Errorf("creating file: %w", err)
+	}
+	stagedPath := file.Name()
 	defer func() {
-		file.Sync()
 		file.Close()
+		os.Remove(stagedPath)
 	}()
 
-	waw := &writerAtWrapper{file}
-	progressWriter := &progressTracker{
-		Writer:     waw,
-		Oid:        oid,
-		TotalSize:  size,
-		RespWriter: writer,
-		ErrWriter:  stderr,
+	var fileWriter io.WriterAt = file
+	var queued *queuedWriterAt
+	if queue > 0 {
+		queued = newQueuedWriterAt(ctx, file, int(queue))
+		defer queued.Close()
+		fileWriter = queued
+	}
+	var buffered *bufferedWriterAt
+	if bufferSize > 0 {
+		buffered = newBufferedWriterAt(fileWriter, int(bufferSize))
+		fileWriter = buffered
+	}
+	progress.rewind()
+	progress.Writer = fileWriter
+	if size > 0 {
+		progress.Writer = &boundedWriterAt{w: fileWriter, limit: size}
 	}
 
+	concurrency, err := partConcurrency(size, 1)
+	if err != nil {
+		return err
+	}
 	downloader := manager.NewDownloader(client, func(d *manager.Downloader) {
-		d.PartSize = 5 * 1024 * 1024 // 1 MB part size
-		d.Concurrency = 1            // Concurrent downloads
-	})
-
-	_, err = downloader.Download(context.Background(), progressWriter, &s3.GetObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(path.Join(keyPrefix, oid)),
+		d.PartSize = partSize
+		d.Concurrency = concurrency
 	})
 
+	input := &s3.GetObjectInput{
+		Bucket:    aws.String(bucketName),
+		Key:       aws.String(key),
+		VersionId: versionID,
+	}
+	threshold, err := compositeThreshold()
 	if err != nil {
-		fmt.Fprintf(stderr, "Error downloading file: %v\n", err)
-		return
+		return err
+	}
+	if useChecksums() {
+		// The SDK then validates every response carrying a checksum.
+		input.ChecksumMode = types.ChecksumModeEnabled
+		err := checkStoredChecksum(ctx, client, input, oid)
+		if err != nil && !(threshold > 0 && isNotFound(err)) {
+			return err
+		}
+	}
+	_, err = downloader.Download(ctx, progress, input)
+	composite := false
+	if threshold > 0 && isNotFound(err) {
+		composite, err = downloadComposite(ctx, client, downloader, input, progress, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if buffered != nil {
+		if err := buffered.Flush(); err != nil {
+			return fmt.Errorf("writing file: %w", err)
+		}
+	}
+	if queued != nil {
+		if err := queued.Close(); err != nil {
+			return fmt.Errorf("writing file: %w", err)
+		}
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("syncing file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("closing file: %w", err)
+	}
+	// Reassembled objects are always verified, as nothing else checks that
+	// their chunks fit together, and so are those recorded in a sidecar.
+	sidecar := envBool("S3_WRITE_CHECKSUM_SIDECAR")
+	if composite || sidecar || shouldVerify(verifyDownload) {
+		if err := verifyFile(stagedPath, oid); err != nil {
+			return fmt.Errorf("verifying download: %w", err)
+		}
+	}
+	if err := moveStaged(stagedPath, localPath, fileMode); err != nil {
+		return fmt.Errorf("moving file into place: %w", err)
+	}
+	if sidecar {
+		if err := writeChecksumSidecar(localPath, oid, fileMode); err != nil {
+			return fmt.Errorf("writing checksum sidecar: %w", err)
+		}
+	}
+	if envBool("S3_FSYNC_DIR") {
+		if err := syncDir(filepath.Dir(localPath)); err != nil {
+			return fmt.Errorf("syncing directory: %w", err)
+		}
 	}
+	return nil
+}
 
-	complete := &api.TransferResponse{Event: "complete", Oid: oid, Path: localPath, Error: nil}
-	err = api.SendResponse(complete, writer, stderr)
+// syncDir flushes a directory, so the entries created in it survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
 	if err != nil {
-		fmt.Fprintf(stderr, "Unable to send completion message: %v\n", err)
+		return err
 	}
+	defer d.Close()
+	return d.Sync()
 }
 
 func store(oid string, size int64, writer io.Writer, stderr io.Writer) {
-	client, err := createS3Client()
+	start := time.Now()
+	localPath := localObjectPath(oid)
+	endMarker := markTransfer(oid, "upload", size, stderr)
+	err := uploadObject(context.Background(), oid, size, localPath, writer, stderr)
+	if err == nil {
+		err = uploadToMirror(context.Background(), oid, size, localPath, stderr)
+	}
+	if err == nil {
+		err = verifyReadback(context.Background(), oid, size, stderr)
+	}
+	endMarker(err)
+	summary.record("upload", size, err)
 	if err != nil {
-		fmt.Fprintf(stderr, "Error creating client: %v\n", err)
+		err = checkBucketRegion(context.Background(), err, stderr)
+		sendTransferError(oid, "Error uploading file", err, writer, stderr)
 		return
 	}
-	bucketName := os.Getenv("S3_BUCKET")
-	keyPrefix, err := getGitRepoName()
-	if err != nil {
-		fmt.Fprintf(stderr, "Error getting git repo name from cwd: %v\n", err)
+	if err := writeAuditRecord(context.Background(), oid, size); err != nil {
+		sendTransferError(oid, "Error writing audit record", err, writer, stderr)
 		return
 	}
 
-	localPath := ".git/lfs/objects/" + oid[:2] + "/" + oid[2:4] + "/" + oid
+	recordTransfer(oid, size, "upload", stderr)
+	writeManifestEntry(context.Background(), oid, size, stderr)
+
+	sendComplete(oid, "", writer, stderr)
+	notifyWebhook(oid, "upload", size, start, stderr)
+}
+
+// uploadObject sends the file at localPath to the bucket, reporting progress
+// to writer.
+func uploadObject(ctx context.Context, oid string, size int64, localPath string, writer io.Writer, stderr io.Writer) error {
+	return uploadObjectTo(ctx, os.Getenv("S3_BUCKET"), oid, size, localPath, writer, stderr)
+}
+
+// uploadObjectTo sends the file at localPath to bucketName.
+func uploadObjectTo(ctx context.Context, bucketName string, oid string, size int64, localPath string, writer io.Writer, stderr io.Writer) error {
+	ctx, cancel, err := transferContext(ctx, size)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	client, err := getS3Client()
+	if err != nil {
+		return fmt.Errorf("creating client: %w", err)
+	}
+	key, err := uploadKey(oid)
+	if err != nil {
+		return err
+	}
+
+	storageClass, err := getStorageClass()
+	if err != nil {
+		return err
+	}
+	checkStorageClass(storageClass, oid, size, stderr)
+
+	// Re-uploading to a versioned bucket would only add a redundant version.
+	if envBool("S3_SKIP_EXISTING") {
+		existingKey, err := locateKey(ctx, client, oid)
+		if err != nil {
+			return err
+		}
+		if envBool("S3_SKIP_EXISTING_CHECKSUM") {
+			// Keys are content addressed, so a stored checksum not
+			// matching the oid means the object is corrupted.
+			input := &s3.GetObjectInput{Bucket: aws.String(bucketName), Key: aws.String(existingKey)}
+			if err := checkStoredChecksum(ctx, client, input, oid); err != nil && !isNotFound(err) {
+				return fmt.Errorf("checking existing object: %w", err)
+			}
+		}
+		exists, err := objectExists(ctx, client, bucketName, existingKey, oid, size, localPath)
+		if err != nil {
+			return fmt.Errorf("checking for existing object: %w", err)
+		}
+		if exists {
+			fmt.Fprintf(stderr, "Skipping upload of %s, already in the bucket\n", oid)
+			return nil
+		}
+	}
+
+	partSize, err := uploadPartSize()
+	if err != nil {
+		return err
+	}
+	partSize = fitPartSize(partSize, size, oid, stderr)
+
+	// Never upload corrupted content under the oid.
+	if shouldVerify(verifyUpload) {
+		if err := verifyFile(localPath, oid); err != nil {
+			return fmt.Errorf("verifying file: %w", err)
+		}
+	}
+
 	file, err := os.Open(localPath)
 	if err != nil {
-		fmt.Fprintf(stderr, "Error opening file: %v\n", err)
-		return
+		return fmt.Errorf("opening file: %w", err)
 	}
 	defer func() {
 		file.Sync()
 		file.Close()
 	}()
 
+	noOverwrite := envBool("S3_NO_OVERWRITE")
+	leaveParts := envBool("S3_LEAVE_PARTS_ON_ERROR")
+	concurrency, err := partConcurrency(size, manager.DefaultUploadConcurrency)
+	if err != nil {
+		return err
+	}
 	uploader := manager.NewUploader(client, func(u *manager.Uploader) {
-		u.PartSize = 5 * 1024 * 1024 // 1 MB part size
-		// u.LeavePartsOnError = true        // Keep uploaded parts on error
+		u.PartSize = partSize
+		u.LeavePartsOnError = leaveParts // Keep uploaded parts on error
+		u.Concurrency = concurrency
 	})
 
-	progressReader := &progressTracker{
-		Reader:     file,
-		Oid:        oid,
-		TotalSize:  size,
-		RespWriter: writer,
-		ErrWriter:  stderr,
+	// The uploader holds one buffer of a part size per concurrent part, as
+	// do composite uploads per concurrent chunk.
+	release, err := reserveMemory(ctx, partSize*int64(uploader.Concurrency))
+	if err != nil {
+		return err
 	}
+	defer release()
 
-	_, err = uploader.Upload(context.Background(), &s3.PutObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(path.Join(keyPrefix, oid)),
-		Body:   progressReader,
-	})
+	progressReader, err := newProgressTracker(oid, size, writer, stderr)
+	if err != nil {
+		return err
+	}
+	defer progressReader.stop()
+	progressReader.Reader = file
+
+	verifyETag := envBool("S3_VERIFY_ETAG")
+	md5Hash := md5.New()
+	if verifyETag {
+		progressReader.Reader = io.TeeReader(file, md5Hash)
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:       aws.String(bucketName),
+		Key:          aws.String(key),
+		Body:         progressReader,
+		StorageClass: storageClass,
+	}
+	if disposition := os.Getenv("S3_CONTENT_DISPOSITION"); disposition != "" {
+		input.ContentDisposition = aws.String(strings.ReplaceAll(disposition, "{oid}", oid))
+	}
+	if envBool("S3_STORE_OID_METADATA") {
+		input.Metadata = oidMetadataOf(oid, size)
+	}
+	if err := setKMSKey(input); err != nil {
+		return err
+	}
+	if useChecksums() {
+		if err := setUploadChecksum(input, oid, size, partSize); err != nil {
+			return err
+		}
+	}
+	if noOverwrite {
+		// Fail atomically rather than replace an object which exists.
+		input.IfNoneMatch = aws.String("*")
+	}
 
+	threshold, err := compositeThreshold()
 	if err != nil {
-		fmt.Fprintf(stderr, "Error uploading file: %v\n", err)
-		return
+		return err
 	}
 
-	complete := &api.TransferResponse{Event: "complete", Oid: oid, Error: nil}
-	err = api.SendResponse(complete, writer, stderr)
+	upload := func(client *s3.Client) (*manager.UploadOutput, error) {
+		if threshold > 0 && size >= threshold {
+			return nil, compositeUpload(ctx, client, input, file, oid, size, partSize, uploader.Concurrency, progressReader)
+		} else if envBool("S3_RESUMABLE_UPLOAD") && size > partSize {
+			return nil, resumableUpload(ctx, client, input, oid, file, size, partSize, progressReader, stderr)
+		} else if size >= 0 && size <= partSize && !verifyETag {
+			// The size is known from lfs, no need for the uploader to buffer
+			// the whole part to find out.
+			return putObject(ctx, client, input, file, size, progressReader)
+		}
+		uploader.S3 = client
+		return uploader.Upload(ctx, input)
+	}
+	out, err := upload(client)
+	if err != nil && envBool("S3_CHECKSUM_AUTOFALLBACK") && isChecksumError(err) {
+		fmt.Fprintf(stderr, "Retrying upload of %s without checksums after: %s\n", oid, describeError(err))
+		input.ChecksumAlgorithm = ""
+		input.ChecksumSHA256 = nil
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("rewinding file: %w", err)
+		}
+		md5Hash.Reset()
+		progressReader.rewind()
+		out, err = upload(withoutChecksums(client))
+	}
+	if noOverwrite && hasErrorCode(err, "PreconditionFailed") {
+		fmt.Fprintf(stderr, "Object %s already exists, not overwriting it\n", oid)
+		return nil
+	}
+	var multiErr manager.MultiUploadFailure
+	if leaveParts && errors.As(err, &multiErr) {
+		fmt.Fprintf(stderr, "Kept the parts of multipart upload %s for %s, run abort-uploads to remove them\n", multiErr.UploadID(), oid)
+	}
 	if err != nil {
-		fmt.Fprintf(stderr, "Unable to send completion message: %v\n", err)
+		return err
 	}
+
+	if verifyETag && out != nil {
+		return checkETag(out, md5Hash.Sum(nil))
+	}
+	return nil
 }
 
 func getGitRepoName() (string, error) {
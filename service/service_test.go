@@ -0,0 +1,58 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// unsetenv unsets the variables for the duration of the test.
+func unsetenv(t *testing.T, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+}
+
+func TestCreateS3ClientCredentialProcess(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the credential process uses cat")
+	}
+	unsetenv(t, "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN",
+		"AWS_PROFILE", "AWS_DEFAULT_PROFILE", "AWS_CA_BUNDLE", "S3_CREDENTIALS_JSON",
+		"AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_CONTAINER_CREDENTIALS_FULL_URI",
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI")
+	dir := t.TempDir()
+	output := filepath.Join(dir, "credentials.json")
+	process := `{"Version":1,"AccessKeyId":"AKIDPROCESS","SecretAccessKey":"secret","SessionToken":"token"}`
+	if err := os.WriteFile(output, []byte(process), 0600); err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "config")
+	config := "[default]\ncredential_process = cat " + output + "\n"
+	if err := os.WriteFile(configFile, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_CONFIG_FILE", configFile)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	t.Setenv("AWS_REGION", "us-east-1")
+
+	client, err := createS3Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := client.Options().Credentials.Retrieve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyID != "AKIDPROCESS" || creds.SecretAccessKey != "secret" || creds.SessionToken != "token" {
+		t.Errorf("resolved credentials %s, %s, %s, want those of the credential process", creds.AccessKeyID, creds.SecretAccessKey, creds.SessionToken)
+	}
+	if creds.Source != "ProcessProvider" {
+		t.Errorf("credentials come from %s, want ProcessProvider", creds.Source)
+	}
+}
@@ -0,0 +1,24 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// writeChecksumSidecar records the verified oid of the object at localPath
+// in a .sha256 file next to it, in the format of sha256sum. It is written
+// then renamed, so that a sidecar is never seen half written.
+func writeChecksumSidecar(localPath string, oid string, fileMode os.FileMode) error {
+	sidecarPath := localPath + ".sha256"
+	tmpPath := sidecarPath + ".tmp"
+	line := fmt.Sprintf("%s  %s\n", oid, filepath.Base(localPath))
+	if err := os.WriteFile(tmpPath, []byte(line), fileMode); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, sidecarPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// skewWarning is how far the local clock may drift from the server's before
+// it is logged. S3 rejects requests signed more than 15 minutes off.
+const skewWarning = time.Minute
+
+var skewOnce sync.Once
+
+// clockSkewCorrection returns S3_CLOCK_SKEW_CORRECTION. The SDK corrects
+// request times by the skew it detects, and retries requests failing with
+// RequestTimeTooSkewed, unless it is set to false.
+func clockSkewCorrection() (bool, error) {
+	enabled, err := envOptionalBool("S3_CLOCK_SKEW_CORRECTION")
+	if err != nil || enabled == nil {
+		return true, err
+	}
+	return *enabled, nil
+}
+
+// logClockSkew adds a middleware comparing the Date of responses with the
+// local clock, and logging the first large difference.
+func logClockSkew(stack *middleware.Stack) error {
+	return stack.Deserialize.Add(middleware.DeserializeMiddlewareFunc("LogClockSkew", func(ctx context.Context, in middleware.DeserializeInput, next middleware.DeserializeHandler) (middleware.DeserializeOutput, middleware.Metadata, error) {
+		out, metadata, err := next.HandleDeserialize(ctx, in)
+		if resp, ok := out.RawResponse.(*smithyhttp.Response); ok && resp != nil {
+			if serverTime, parseErr := http.ParseTime(resp.Header.Get("Date")); parseErr == nil {
+				skew := time.Until(serverTime).Round(time.Second)
+				if skew > skewWarning || skew < -skewWarning {
+					skewOnce.Do(func() {
+						fmt.Fprintf(DebugLog, "Local clock is %v off the server time, check your system clock\n", skew)
+					})
+				}
+			}
+		}
+		return out, metadata, err
+	}), middleware.After)
+}
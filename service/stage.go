@@ -0,0 +1,81 @@
+package service
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// stageDir returns where objects are downloaded before being moved to
+// localPath, S3_STAGE_DIR or else the directory of localPath.
+func stageDir(localPath string) string {
+	if dir := os.Getenv("S3_STAGE_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Dir(localPath)
+}
+
+// createStaged creates the file oid is downloaded to before being moved to
+// localPath.
+func createStaged(oid string, localPath string, fileMode os.FileMode) (*os.File, error) {
+	return createUnique(stageDir(localPath), oid+".*.tmp", fileMode)
+}
+
+// createUnique creates a file named after pattern in dir, as os.CreateTemp,
+// so that concurrent downloads of the same object never write to the same
+// file. It gets fileMode minus the umask, like os.OpenFile would give it.
+func createUnique(dir string, pattern string, fileMode os.FileMode) (*os.File, error) {
+	file, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Chmod(fileMode &^ currentUmask()); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
+
+// moveStaged atomically moves a downloaded object into place. When the
+// stage directory is on another device, the object is first copied next
+// to localPath and then renamed there.
+func moveStaged(stagedPath string, localPath string, fileMode os.FileMode) error {
+	err := os.Rename(stagedPath, localPath)
+	if err == nil || !isCrossDevice(err) {
+		return err
+	}
+
+	out, err := createUnique(filepath.Dir(localPath), filepath.Base(localPath)+".*.tmp", fileMode)
+	if err != nil {
+		return err
+	}
+	copyPath := out.Name()
+	if err := copyFile(stagedPath, out); err != nil {
+		os.Remove(copyPath)
+		return err
+	}
+	if err := os.Rename(copyPath, localPath); err != nil {
+		os.Remove(copyPath)
+		return err
+	}
+	return os.Remove(stagedPath)
+}
+
+// copyFile copies src into out, flushes it to disk and closes it.
+func copyFile(src string, out *os.File) error {
+	defer out.Close()
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	return out.Close()
+}
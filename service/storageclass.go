@@ -0,0 +1,50 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// minBillableSizes lists storage classes which bill small objects as if
+// they were larger.
+var minBillableSizes = map[types.StorageClass]int64{
+	types.StorageClassStandardIa: 128 * 1024,
+	types.StorageClassOnezoneIa:  128 * 1024,
+	types.StorageClassGlacierIr:  128 * 1024,
+	// Archived objects carry about 40 KB of billed metadata each.
+	types.StorageClassGlacier:     40 * 1024,
+	types.StorageClassDeepArchive: 40 * 1024,
+}
+
+// Objects smaller than this are never moved out of the frequent access tier.
+const minAutoTieringSize = 128 * 1024
+
+// getStorageClass returns the storage class set in S3_STORAGE_CLASS, or an
+// empty class to use the bucket default.
+func getStorageClass() (types.StorageClass, error) {
+	value := strings.ToUpper(os.Getenv("S3_STORAGE_CLASS"))
+	if value == "" {
+		return "", nil
+	}
+	for _, class := range types.StorageClass("").Values() {
+		if string(class) == value {
+			return class, nil
+		}
+	}
+	return "", fmt.Errorf("unknown storage class %s in S3_STORAGE_CLASS", value)
+}
+
+// checkStorageClass warns when an object is too small to benefit from its
+// storage class.
+func checkStorageClass(class types.StorageClass, oid string, size int64, stderr io.Writer) {
+	if minSize, ok := minBillableSizes[class]; ok && size < minSize {
+		fmt.Fprintf(stderr, "Warning: %s is %d bytes but %s bills at least %d bytes per object\n", oid, size, class, minSize)
+	}
+	if class == types.StorageClassIntelligentTiering && size < minAutoTieringSize {
+		fmt.Fprintf(stderr, "Warning: %s is %d bytes, objects under %d bytes are not auto-tiered by %s\n", oid, size, minAutoTieringSize, class)
+	}
+}
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// sessionSummary aggregates the transfers of a Serve session, written to
+// LFS_S3_SUMMARY_FILE at shutdown.
+type sessionSummary struct {
+	mu         sync.Mutex
+	start      time.Time
+	Objects    int   `json:"objects"`
+	Uploads    int   `json:"uploads"`
+	Downloads  int   `json:"downloads"`
+	Bytes      int64 `json:"bytes"`
+	Failures   int   `json:"failures"`
+	DurationMs int64 `json:"duration_ms"`
+}
+
+var summary = &sessionSummary{start: time.Now()}
+
+// record accounts for a finished transfer.
+func (s *sessionSummary) record(direction string, size int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Objects++
+	if err != nil {
+		s.Failures++
+		return
+	}
+	if direction == "upload" {
+		s.Uploads++
+	} else {
+		s.Downloads++
+	}
+	s.Bytes += size
+}
+
+// write appends the summary as a JSON line to LFS_S3_SUMMARY_FILE. Git LFS
+// runs one lfs-s3 process per concurrent transfer, so each adds its own line.
+func (s *sessionSummary) write(stderr io.Writer) {
+	path := os.Getenv("LFS_S3_SUMMARY_FILE")
+	if path == "" {
+		return
+	}
+
+	s.mu.Lock()
+	s.DurationMs = time.Since(s.start).Milliseconds()
+	line, err := json.Marshal(s)
+	s.mu.Unlock()
+	if err != nil {
+		fmt.Fprintf(stderr, "Unable to write summary: %v\n", err)
+		return
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		fmt.Fprintf(stderr, "Unable to write summary: %v\n", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		fmt.Fprintf(stderr, "Unable to write summary: %v\n", err)
+	}
+}
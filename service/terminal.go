@@ -0,0 +1,66 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"git.sr.ht/~ngraves/lfs-s3/api"
+)
+
+// terminalGuard counts the transfer requests of each oid still waiting for
+// their complete event, so that each request is answered exactly once even
+// if a retry tries to answer it again.
+type terminalGuard struct {
+	mu      sync.Mutex
+	pending map[string]int
+}
+
+func newTerminalGuard() *terminalGuard {
+	return &terminalGuard{pending: map[string]int{}}
+}
+
+// expect records a transfer request of oid.
+func (g *terminalGuard) expect(oid string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.pending[oid]++
+}
+
+// claim reports whether a request of oid is still waiting for its complete
+// event, and takes it.
+func (g *terminalGuard) claim(oid string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.pending[oid] == 0 {
+		return false
+	}
+	g.pending[oid]--
+	if g.pending[oid] == 0 {
+		delete(g.pending, oid)
+	}
+	return true
+}
+
+// claimTerminal reports whether the complete event of a transfer of oid may
+// be sent on writer. Only the writer of Serve guards against duplicates.
+func claimTerminal(oid string, writer io.Writer, stderr io.Writer) bool {
+	sw, ok := writer.(*syncWriter)
+	if !ok || sw.terminals == nil || sw.terminals.claim(oid) {
+		return true
+	}
+	fmt.Fprintf(stderr, "Dropping duplicate completion of %s\n", oid)
+	return false
+}
+
+// sendComplete reports a successful transfer of oid to lfs, unless the
+// request was already answered.
+func sendComplete(oid string, path string, writer io.Writer, stderr io.Writer) {
+	if !claimTerminal(oid, writer, stderr) {
+		return
+	}
+	complete := &api.TransferResponse{Event: "complete", Oid: oid, Path: path, Error: nil}
+	if err := api.SendResponse(complete, writer, stderr); err != nil {
+		fmt.Fprintf(stderr, "Unable to send completion message: %v\n", err)
+	}
+}
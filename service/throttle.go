@@ -0,0 +1,70 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+)
+
+const (
+	defaultSlowDownBackoff = 2 * time.Second
+	maxSlowDownBackoff     = time.Minute
+)
+
+// slowDownBackoffBase returns S3_SLOWDOWN_BACKOFF, the delay before the
+// first retry of a throttled request, doubled on each further attempt.
+func slowDownBackoffBase() (time.Duration, error) {
+	base, err := envDuration("S3_SLOWDOWN_BACKOFF", defaultSlowDownBackoff)
+	if err != nil {
+		return 0, err
+	}
+	if base <= 0 {
+		return 0, fmt.Errorf("S3_SLOWDOWN_BACKOFF must be positive")
+	}
+	return base, nil
+}
+
+// slowDownBackoff waits longer than the default backoff before retrying a
+// request throttled with SlowDown, and lowers the global limit by one slot
+// each time, down to a single request.
+type slowDownBackoff struct {
+	fallback retry.BackoffDelayer
+	base     time.Duration
+}
+
+func (b *slowDownBackoff) BackoffDelay(attempt int, err error) (time.Duration, error) {
+	if !hasErrorCode(err, "SlowDown") {
+		return b.fallback.BackoffDelay(attempt, err)
+	}
+	throttleRequests()
+	delay := min(b.base<<min(attempt-1, 10), maxSlowDownBackoff)
+	// Jitter between half and the full delay, so throttled transfers don't
+	// retry in lockstep.
+	return delay/2 + rand.N(delay/2+1), nil
+}
+
+var (
+	throttleMu   sync.Mutex
+	throttledOut int64
+)
+
+// throttleRequests takes one slot of S3_GLOBAL_CONCURRENCY away for the rest
+// of the session, keeping at least one.
+func throttleRequests() {
+	if limit, err := globalConcurrency(); err != nil || limit <= 0 {
+		return
+	}
+	throttleMu.Lock()
+	defer throttleMu.Unlock()
+	if requestLimit-throttledOut <= 1 {
+		return
+	}
+	throttledOut++
+	fmt.Fprintf(DebugLog, "Throttled by the endpoint, lowering the concurrency to %d requests\n", requestLimit-throttledOut)
+	// The slot may be in use, so wait for it without holding up the retry.
+	go requestSem.Acquire(context.Background(), 1)
+}
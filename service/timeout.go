@@ -0,0 +1,47 @@
+package service
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// apiCallTimeout returns S3_API_CALL_TIMEOUT, the ceiling of every single S3
+// call including its retries, or 0 when calls are only bounded by the
+// transfer deadline.
+func apiCallTimeout() (time.Duration, error) {
+	return envDuration("S3_API_CALL_TIMEOUT", 0)
+}
+
+// withAPICallTimeout adds a middleware giving each operation its own
+// deadline. Object bodies are read after GetObject returns, so for GetObject
+// the deadline stays in effect until the body is closed.
+func withAPICallTimeout(timeout time.Duration) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("APICallTimeout", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			out, metadata, err := next.HandleInitialize(ctx, in)
+			if object, ok := out.Result.(*s3.GetObjectOutput); ok && err == nil && object.Body != nil {
+				object.Body = &cancelingBody{ReadCloser: object.Body, cancel: sync.OnceFunc(cancel)}
+				return out, metadata, err
+			}
+			cancel()
+			return out, metadata, err
+		}), middleware.Before)
+	}
+}
+
+// cancelingBody cancels the context of its call once closed.
+type cancelingBody struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (b *cancelingBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
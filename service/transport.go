@@ -0,0 +1,188 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+)
+
+// LFS mostly transfers many small objects to a single endpoint, so keep far
+// more idle connections to it around than the SDK does by default.
+const (
+	defaultMaxIdleConns = 100
+)
+
+// Fail fast when the endpoint can't be reached, well before a transfer
+// itself would time out.
+const (
+	defaultDNSTimeout          = 5 * time.Second
+	defaultDialTimeout         = 10 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+)
+
+// slowDNSThreshold is how long resolving the endpoint may take before it is
+// logged as slow.
+const slowDNSThreshold = time.Second
+
+// newHTTPClient builds the HTTP client used for all S3 requests.
+func newHTTPClient() (*awshttp.BuildableClient, error) {
+	maxIdleConns, err := envInt64("S3_MAX_IDLE_CONNS", defaultMaxIdleConns)
+	if err != nil {
+		return nil, err
+	}
+	idleConnTimeout, err := envDuration("S3_IDLE_CONN_TIMEOUT", awshttp.DefaultHTTPTransportIdleConnTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	dnsTimeout, err := envDuration("S3_DNS_TIMEOUT", defaultDNSTimeout)
+	if err != nil {
+		return nil, err
+	}
+	dialTimeout, err := envDuration("S3_DIAL_TIMEOUT", defaultDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	tlsHandshakeTimeout, err := envDuration("S3_TLS_HANDSHAKE_TIMEOUT", defaultTLSHandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	certPin, err := certPin()
+	if err != nil {
+		return nil, err
+	}
+	forceHTTP1, forceHTTP2 := envBool("S3_FORCE_HTTP1"), envBool("S3_FORCE_HTTP2")
+	if forceHTTP1 && forceHTTP2 {
+		return nil, fmt.Errorf("S3_FORCE_HTTP1 and S3_FORCE_HTTP2 cannot both be set")
+	}
+
+	forceIPv4 := envBool("S3_FORCE_IPV4")
+
+	return awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+		if certPin != nil {
+			if tr.TLSClientConfig == nil {
+				tr.TLSClientConfig = &tls.Config{}
+			}
+			tr.TLSClientConfig.VerifyConnection = verifyCertPin(certPin)
+		}
+		// Some gateways misbehave over one protocol or the other. HTTP/2
+		// to an http endpoint is spoken without TLS, with prior knowledge.
+		if forceHTTP1 || forceHTTP2 {
+			tr.Protocols = new(http.Protocols)
+			tr.Protocols.SetHTTP1(forceHTTP1)
+			tr.Protocols.SetHTTP2(forceHTTP2)
+			tr.Protocols.SetUnencryptedHTTP2(forceHTTP2)
+			tr.ForceAttemptHTTP2 = forceHTTP2
+		}
+		tr.DisableKeepAlives = false
+		tr.MaxIdleConns = int(maxIdleConns)
+		tr.MaxIdleConnsPerHost = int(maxIdleConns)
+		tr.IdleConnTimeout = idleConnTimeout
+		tr.TLSHandshakeTimeout = tlsHandshakeTimeout
+	}).WithDialerOptions(func(d *net.Dialer) {
+		d.Timeout = dialTimeout
+	}).WithTransportOptions(func(tr *http.Transport) {
+		tr.DialContext = resolvingDial(tr.DialContext, net.DefaultResolver, dnsTimeout)
+		if forceIPv4 {
+			tr.DialContext = ipv4Dial(tr.DialContext)
+		}
+	}), nil
+}
+
+// ipv4Dial only dials over IPv4, for hosts where IPv6 connections hang.
+func ipv4Dial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if network == "tcp" {
+			network = "tcp4"
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// resolvingDial resolves the host before dialing, bounded by its own
+// timeout, so that slow DNS shows up as such rather than as a hanging
+// connection. The resolution is only timed: the connection is still dialed
+// to addr, so that the dialer races IPv6 and IPv4 as usual on dual-stack
+// hosts instead of waiting out every IPv6 address in turn.
+func resolvingDial(dial func(ctx context.Context, network, addr string) (net.Conn, error), resolver *net.Resolver, timeout time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+
+		resolveCtx, cancel := context.WithTimeout(ctx, timeout)
+		start := time.Now()
+		_, err = resolver.LookupHost(resolveCtx, host)
+		cancel()
+		elapsed := time.Since(start).Round(time.Millisecond)
+		if err != nil {
+			return nil, fmt.Errorf("DNS resolution of %s failed after %v: %w", host, elapsed, err)
+		}
+		if elapsed >= slowDNSThreshold {
+			fmt.Fprintf(DebugLog, "DNS resolution of %s took %v\n", host, elapsed)
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// ownedClient builds an HTTP client from buildable whose transport is kept,
+// unlike the one of a BuildableClient, so that its idle connections can be
+// closed. As with the SDK client, only 307 and 308 redirects are followed,
+// since they keep the method of the request.
+func ownedClient(buildable *awshttp.BuildableClient) (*http.Client, *http.Transport) {
+	tr := buildable.GetTransport()
+	return &http.Client{
+		Transport: tr,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			switch req.Response.StatusCode {
+			case http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+				if len(via) < 10 {
+					return nil
+				}
+			}
+			return http.ErrUseLastResponse
+		},
+	}, tr
+}
+
+// certPin returns the SHA-256 fingerprint of the leaf certificate expected
+// from the endpoint, set in S3_CERT_PIN as hexadecimal with optional colons.
+func certPin() ([]byte, error) {
+	value := os.Getenv("S3_CERT_PIN")
+	if value == "" {
+		return nil, nil
+	}
+	pin, err := hex.DecodeString(strings.ReplaceAll(value, ":", ""))
+	if err != nil || len(pin) != sha256.Size {
+		return nil, fmt.Errorf("invalid SHA-256 fingerprint %q in S3_CERT_PIN", value)
+	}
+	return pin, nil
+}
+
+// verifyCertPin rejects connections whose leaf certificate doesn't match the
+// pin. It runs on top of the usual chain verification, and unlike
+// VerifyPeerCertificate also on resumed TLS sessions.
+func verifyCertPin(pin []byte) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("no certificate presented by %s, expected the one pinned in S3_CERT_PIN", cs.ServerName)
+		}
+		sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+		if !bytes.Equal(sum[:], pin) {
+			return fmt.Errorf("certificate of %s has fingerprint %x, not the one pinned in S3_CERT_PIN", cs.ServerName, sum)
+		}
+		return nil
+	}
+}
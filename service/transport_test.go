@@ -0,0 +1,180 @@
+package service
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// serveDNS answers every A query with ipv4 and every AAAA query with ipv6,
+// on a local UDP port, until the test ends.
+func serveDNS(t *testing.T, ipv4, ipv6 net.IP) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if reply := dnsReply(buf[:n], ipv4, ipv6); reply != nil {
+				conn.WriteTo(reply, from)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// dnsReply builds the answer to a query of a single question.
+func dnsReply(query []byte, ipv4, ipv6 net.IP) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	end += 5
+	if end > len(query) {
+		return nil
+	}
+	reply := append([]byte{}, query[:end]...)
+	binary.BigEndian.PutUint16(reply[2:], 0x8180)
+	binary.BigEndian.PutUint16(reply[4:], 1)
+	binary.BigEndian.PutUint16(reply[8:], 0)
+	binary.BigEndian.PutUint16(reply[10:], 0)
+
+	var rdata net.IP
+	switch binary.BigEndian.Uint16(query[end-4:]) {
+	case 1:
+		rdata = ipv4.To4()
+	case 28:
+		rdata = ipv6.To16()
+	}
+	if rdata == nil {
+		binary.BigEndian.PutUint16(reply[6:], 0)
+		return reply
+	}
+	binary.BigEndian.PutUint16(reply[6:], 1)
+	reply = append(reply, 0xc0, 12)
+	reply = append(reply, query[end-4:end]...)
+	reply = append(reply, 0, 0, 0, 60)
+	reply = binary.BigEndian.AppendUint16(reply, uint16(len(rdata)))
+	return append(reply, rdata...)
+}
+
+func TestResolvingDialDualStack(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	// The host resolves to an IPv6 address which never answers, from the
+	// discard-only prefix, then to the IPv4 address listened on.
+	server := serveDNS(t, net.ParseIP("127.0.0.1"), net.ParseIP("100::1"))
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp4", server)
+		},
+	}
+	dialer := &net.Dialer{Resolver: resolver, Timeout: 30 * time.Second}
+	dial := resolvingDial(dialer.DialContext, resolver, time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	conn, err := dial(ctx, "tcp", net.JoinHostPort("dualstack.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("connecting took %v, the IPv6 address should have been raced", elapsed)
+	}
+	if addr := conn.RemoteAddr().(*net.TCPAddr); addr.IP.To4() == nil {
+		t.Errorf("connected to %v, want the IPv4 address", addr)
+	}
+}
+
+func TestResolvingDialTimeout(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp4", conn.LocalAddr().String())
+		},
+	}
+	dialer := &net.Dialer{Resolver: resolver}
+	dial := resolvingDial(dialer.DialContext, resolver, 100*time.Millisecond)
+
+	start := time.Now()
+	if _, err := dial(context.Background(), "tcp", "unanswered.test:443"); err == nil {
+		t.Fatal("dialed a host whose resolution never answers")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("resolution gave up after %v, want about 100ms", elapsed)
+	}
+}
+
+func TestForceHTTP2Unencrypted(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetHTTP1(true)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	defer server.Close()
+
+	unsetenv(t, "S3_FORCE_HTTP1", "S3_CERT_PIN", "S3_FORCE_IPV4")
+	t.Setenv("S3_FORCE_HTTP2", "true")
+	client, err := newHTTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "HTTP/2.0" {
+		t.Errorf("spoke %s to an http endpoint, want HTTP/2.0", body)
+	}
+}
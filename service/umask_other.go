@@ -0,0 +1,10 @@
+//go:build !unix
+
+package service
+
+import "os"
+
+// currentUmask returns no umask, which only exists on unix.
+func currentUmask() os.FileMode {
+	return 0
+}
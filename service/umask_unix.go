@@ -0,0 +1,24 @@
+//go:build unix
+
+package service
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// processUmask is read once at startup, since reading it means setting it,
+// which would race with files being created later on.
+var processUmask = readUmask()
+
+func readUmask() os.FileMode {
+	umask := unix.Umask(0)
+	unix.Umask(umask)
+	return os.FileMode(umask)
+}
+
+// currentUmask returns the umask of the process.
+func currentUmask() os.FileMode {
+	return processUmask
+}
@@ -0,0 +1,58 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Where OID verification runs, set by S3_VERIFY. Downloads are verified by
+// default, since they come from outside.
+const (
+	verifyAlways   = "always"
+	verifyDownload = "download"
+	verifyUpload   = "upload"
+	verifyNever    = "never"
+)
+
+// getVerifyMode returns the verification mode set in S3_VERIFY.
+func getVerifyMode() (string, error) {
+	switch mode := os.Getenv("S3_VERIFY"); mode {
+	case "":
+		return verifyDownload, nil
+	case verifyAlways, verifyDownload, verifyUpload, verifyNever:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown mode %s in S3_VERIFY, expected always, download, upload or never", mode)
+	}
+}
+
+// shouldVerify reports whether transfers in direction, "upload" or
+// "download", check the OID of their content.
+func shouldVerify(direction string) bool {
+	mode, err := getVerifyMode()
+	if err != nil {
+		return true
+	}
+	return mode == verifyAlways || mode == direction
+}
+
+// verifyFile checks that the SHA-256 of the file at path is oid.
+func verifyFile(path string, oid string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != oid {
+		return fmt.Errorf("content has oid %s, expected %s", got, oid)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"golang.org/x/sync/errgroup"
+)
+
+// mismatchedObject is an object whose stored size differs from the listed
+// one.
+type mismatchedObject struct {
+	Oid          string `json:"oid"`
+	ExpectedSize int64  `json:"expected_size"`
+	StoredSize   int64  `json:"stored_size"`
+}
+
+// failedObject is an object that could not be checked.
+type failedObject struct {
+	Oid   string `json:"oid"`
+	Error string `json:"error"`
+}
+
+// verifyReport is printed by Verify.
+type verifyReport struct {
+	Checked    int                `json:"checked"`
+	Present    int                `json:"present"`
+	Missing    []string           `json:"missing"`
+	Mismatched []mismatchedObject `json:"mismatched"`
+	WrongOid   []string           `json:"wrong_oid"`
+	Failed     []failedObject     `json:"failed"`
+}
+
+// Verify checks with HeadObject calls that the objects listed in input, in
+// the format read by Prefetch, are in the bucket with the listed size and,
+// when stored as metadata, oid, LFS_S3_VERIFY_CONCURRENCY at a time.
+// Composite objects are checked against their manifest. It prints a JSON
+// report to stdout and returns false if any object is missing, mismatched
+// or uncheckable.
+func Verify(input io.Reader, stdout, stderr io.Writer) bool {
+	if err := checkConfig(); err != nil {
+		fmt.Fprintf(stdout, "Configuration error: %v\n", err)
+		return false
+	}
+	workers, err := envInt64("LFS_S3_VERIFY_CONCURRENCY", defaultPrefetchConcurrency)
+	if err != nil || workers < 1 {
+		fmt.Fprintf(stdout, "Configuration error: invalid LFS_S3_VERIFY_CONCURRENCY\n")
+		return false
+	}
+	items, err := readOidList(input)
+	if err != nil {
+		fmt.Fprintf(stdout, "Error reading the object list: %v\n", err)
+		return false
+	}
+	client, err := getS3Client()
+	if err != nil {
+		fmt.Fprintf(stdout, "Error creating the S3 client: %v\n", err)
+		return false
+	}
+
+	ctx := context.Background()
+	bucket := os.Getenv("S3_BUCKET")
+	report := verifyReport{
+		Checked:    len(items),
+		Missing:    []string{},
+		Mismatched: []mismatchedObject{},
+		WrongOid:   []string{},
+		Failed:     []failedObject{},
+	}
+	var mu sync.Mutex
+	var group errgroup.Group
+	group.SetLimit(int(workers))
+	for _, item := range items {
+		group.Go(func() error {
+			found, storedSize, storedOid, err := storedObject(ctx, client, bucket, item.oid)
+
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				fmt.Fprintf(stderr, "Error checking %s: %v\n", item.oid, err)
+				report.Failed = append(report.Failed, failedObject{Oid: item.oid, Error: describeError(err)})
+			case !found:
+				report.Missing = append(report.Missing, item.oid)
+			case item.size > 0 && storedSize != item.size:
+				// Sizes are only listed when given as plain byte counts.
+				report.Mismatched = append(report.Mismatched, mismatchedObject{Oid: item.oid, ExpectedSize: item.size, StoredSize: storedSize})
+			case storedOid != "" && storedOid != item.oid:
+				report.WrongOid = append(report.WrongOid, item.oid)
+			default:
+				report.Present++
+			}
+			return nil
+		})
+	}
+	group.Wait()
+
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		fmt.Fprintf(stderr, "Error writing the report: %v\n", err)
+		return false
+	}
+	return report.Present == report.Checked
+}
+
+// storedObject returns whether the object oid is in bucket, its size and
+// the oid it is stored with, if any, reading the manifest of composite
+// objects.
+func storedObject(ctx context.Context, client *s3.Client, bucket string, oid string) (bool, int64, string, error) {
+	key, err := locateKey(ctx, client, oid)
+	if err != nil {
+		return false, 0, "", err
+	}
+	head, err := headStoredObject(ctx, client, bucket, key)
+	if err != nil {
+		return false, 0, "", err
+	}
+	if head != nil {
+		return true, aws.ToInt64(head.ContentLength), head.Metadata[oidMetadata], nil
+	}
+	manifest, err := storedComposite(ctx, client, bucket, key)
+	if err != nil || manifest == nil {
+		return false, 0, "", err
+	}
+	return true, manifest.Size, manifest.Oid, nil
+}
@@ -0,0 +1,67 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	pinnedVersions    map[string]string
+	pinnedVersionsErr error
+	pinnedVersionOnce sync.Once
+)
+
+// loadPinnedVersions reads S3_VERSION_FILE, which pins objects to a version
+// of a versioned bucket with one "<oid> <version-id>" line per object. Empty
+// lines and lines starting with # are ignored.
+func loadPinnedVersions() (map[string]string, error) {
+	pinnedVersionOnce.Do(func() {
+		path := os.Getenv("S3_VERSION_FILE")
+		if path == "" {
+			return
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			pinnedVersionsErr = fmt.Errorf("S3_VERSION_FILE: %w", err)
+			return
+		}
+		defer file.Close()
+
+		versions := map[string]string{}
+		scanner := bufio.NewScanner(file)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" || strings.HasPrefix(text, "#") {
+				continue
+			}
+			fields := strings.Fields(text)
+			if len(fields) != 2 {
+				pinnedVersionsErr = fmt.Errorf("S3_VERSION_FILE line %d: expected an oid and a version id", line)
+				return
+			}
+			versions[fields[0]] = fields[1]
+		}
+		if err := scanner.Err(); err != nil {
+			pinnedVersionsErr = fmt.Errorf("S3_VERSION_FILE: %w", err)
+			return
+		}
+		pinnedVersions = versions
+	})
+	return pinnedVersions, pinnedVersionsErr
+}
+
+// pinnedVersion returns the version to download for oid, or nil for the
+// latest one.
+func pinnedVersion(oid string) (*string, error) {
+	versions, err := loadPinnedVersions()
+	if err != nil {
+		return nil, err
+	}
+	if version, ok := versions[oid]; ok {
+		return &version, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const defaultWebhookTimeout = 2 * time.Second
+
+// webhookPayload is posted to LFS_S3_WEBHOOK_URL after every completed
+// transfer.
+type webhookPayload struct {
+	Oid        string `json:"oid"`
+	Direction  string `json:"direction"`
+	Size       int64  `json:"size"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// webhookURL returns LFS_S3_WEBHOOK_URL, or an empty string when not set.
+func webhookURL() (string, error) {
+	value := os.Getenv("LFS_S3_WEBHOOK_URL")
+	if value == "" {
+		return "", nil
+	}
+	parsed, err := url.Parse(value)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "", fmt.Errorf("invalid LFS_S3_WEBHOOK_URL %q, expected an http or https URL", value)
+	}
+	return value, nil
+}
+
+// notifyWebhook posts a completed transfer to LFS_S3_WEBHOOK_URL, if set.
+// It is called once lfs was told about the completion, and failures are
+// only logged.
+func notifyWebhook(oid string, direction string, size int64, start time.Time, stderr io.Writer) {
+	target, err := webhookURL()
+	if err != nil || target == "" {
+		return
+	}
+	timeout, err := envDuration("LFS_S3_WEBHOOK_TIMEOUT", defaultWebhookTimeout)
+	if err != nil {
+		return
+	}
+	body, err := json.Marshal(webhookPayload{
+		Oid:        oid,
+		Direction:  direction,
+		Size:       size,
+		DurationMs: time.Since(start).Milliseconds(),
+	})
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		fmt.Fprintf(stderr, "Unable to notify webhook of %s: %v\n", oid, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintf(stderr, "Unable to notify webhook of %s: %v\n", oid, err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		fmt.Fprintf(stderr, "Webhook refused the notification of %s: %s\n", oid, resp.Status)
+	}
+}